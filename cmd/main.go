@@ -1,9 +1,186 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/inf-rno/psink/pkg/psync"
 )
 
+const uriHelp = "redis://[[user]:password@]host[:port][/db][?options], rediss://... for TLS or unix:///path/to/redis.sock[?options]"
+
+const usage = `Usage:
+  %[1]s [sync] [flags]                 replicate a source into a destination
+  %[1]s restore <file|-> --to <uri>    load an rdb file into a destination
+  %[1]s aof <file|dir> --to <uri>      replay an aof, a multi part aof manifest
+                                      or the directory holding one
+  %[1]s pitr <rdb> --archive <dir> --to <uri> --until <time>
+                                      restore an rdb and replay the archived
+                                      replication stream up to a point in time
+
+Run %[1]s <command> -h for the flags of a command.
+
+URI options: db (only 0, all databases are covered), dial_timeout, read_timeout,
+write_timeout, keepalive and for rediss:// tls_ca, tls_cert, tls_key,
+tls_server_name, tls_insecure
+`
+
 func main() {
-	psync.New("localhost:6379", "localhost:6380").Go()
+	args := os.Args[1:]
+	cmd := "sync"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		cmd, args = args[0], args[1:]
+	}
+	var err error
+	switch cmd {
+	case "sync":
+		err = syncCmd(args)
+	case "restore":
+		err = restoreCmd(args)
+	case "aof":
+		err = aofCmd(args)
+	case "pitr":
+		err = pitrCmd(args)
+	case "help":
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n"+usage, cmd, os.Args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func syncCmd(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	src := fs.String("src", "redis://localhost:6379", "source redis, "+uriHelp)
+	dest := fs.String("dest", "redis://localhost:6380", "destination redis, "+uriHelp)
+	replTimeout := fs.Duration("repl-timeout", 0, "how long the replication stream may stay silent, defaults to the read_timeout of the source or 6 of its ping periods")
+	spoolDir := fs.String("spool-dir", "", "directory to download the rdb to and spool the replication stream in while the rdb is loaded")
+	spoolLimit := fs.Int64("spool-limit", 0, "maximum bytes of replication stream to spool during the load, 0 for no limit")
+	rdbFile := fs.String("rdb-file", "", "file to save the rdb of a full resync to, once its checksum is verified")
+	checkpoint := fs.String("checkpoint", "", "file to persist the replication position to, enables resuming after a restart")
+	interval := fs.Duration("checkpoint-interval", time.Second, "how often the checkpoint is written")
+	load := loadFlags(fs)
+	archiveDir := fs.String("archive-dir", "", "directory to archive the replication stream to")
+	segmentSize := fs.Int64("archive-segment-size", 64<<20, "bytes after which an archive segment is rotated, 0 for no limit")
+	segmentAge := fs.Duration("archive-segment-age", time.Hour, "age after which an archive segment is rotated, 0 for no limit")
+	retainSegments := fs.Int("archive-retain-segments", 0, "number of archive segments to keep, 0 for no limit")
+	retainAge := fs.Duration("archive-retain-age", 0, "how long archive segments are kept, 0 for no limit")
+	fs.Parse(args)
+
+	opts := []psync.Option{
+		psync.WithReplTimeout(*replTimeout),
+		psync.WithLoadOptions(*load),
+	}
+	if *spoolDir != "" {
+		opts = append(opts, psync.WithSpool(*spoolDir, *spoolLimit))
+	}
+	if *rdbFile != "" {
+		opts = append(opts, psync.WithRDBFile(*rdbFile))
+	}
+	if *archiveDir != "" {
+		opts = append(opts, psync.WithArchive(*archiveDir, psync.ArchiveOptions{
+			SegmentSize:    *segmentSize,
+			SegmentAge:     *segmentAge,
+			RetainSegments: *retainSegments,
+			RetainAge:      *retainAge,
+		}))
+	}
+	if *checkpoint != "" {
+		opts = append(opts, psync.WithCheckpoint(*checkpoint, *interval))
+	}
+	p, err := psync.New(*src, *dest, opts...)
+	if err != nil {
+		return err
+	}
+	return p.Go()
+}
+
+func restoreCmd(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	to := fs.String("to", "", "destination redis, "+uriHelp)
+	flush := fs.Bool("flush", false, "flush the destination before loading")
+	load := loadFlags(fs)
+	files := parseArgs(fs, args)
+	if len(files) != 1 || *to == "" {
+		return fmt.Errorf("usage: restore <file|-> --to <uri>")
+	}
+	return psync.Restore(files[0], *to, *flush, *load)
+}
+
+func aofCmd(args []string) error {
+	fs := flag.NewFlagSet("aof", flag.ExitOnError)
+	to := fs.String("to", "", "destination redis, "+uriHelp)
+	flush := fs.Bool("flush", false, "flush the destination before replaying")
+	load := loadFlags(fs)
+	files := parseArgs(fs, args)
+	if len(files) != 1 || *to == "" {
+		return fmt.Errorf("usage: aof <file|dir> --to <uri>")
+	}
+	return psync.ReplayAOF(files[0], *to, *flush, *load)
+}
+
+func pitrCmd(args []string) error {
+	fs := flag.NewFlagSet("pitr", flag.ExitOnError)
+	archive := fs.String("archive", "", "directory of the archived replication stream")
+	to := fs.String("to", "", "destination redis, "+uriHelp)
+	until := fs.String("until", "", "time to recover to, as RFC 3339 or unix seconds")
+	untilOffset := fs.Int64("until-offset", 0, "replication offset to recover to")
+	flush := fs.Bool("flush", false, "flush the destination before loading")
+	load := loadFlags(fs)
+	files := parseArgs(fs, args)
+	if len(files) != 1 || *archive == "" || *to == "" || (*until == "" && *untilOffset == 0) {
+		return fmt.Errorf("usage: pitr <rdb> --archive <dir> --to <uri> --until <time> | --until-offset <offset>")
+	}
+	target := psync.RecoveryTarget{Offset: *untilOffset}
+	if *until != "" {
+		t, err := parseTime(*until)
+		if err != nil {
+			return err
+		}
+		target.Time = t
+	}
+	return psync.Recover(files[0], *archive, *to, target, *flush, *load)
+}
+
+// loadFlags registers the flags that control how rdbs are loaded.
+func loadFlags(fs *flag.FlagSet) *psync.LoadOptions {
+	o := &psync.LoadOptions{}
+	fs.BoolVar(&o.SkipModules, "skip-modules", false, "skip module values the destination can't restore instead of failing")
+	fs.BoolVar(&o.WarnChecksum, "warn-checksum", false, "only report an rdb checksum mismatch instead of failing the load")
+	fs.IntVar(&o.ChunkSize, "chunk-size", 1000, "elements of a collection written per command")
+	fs.IntVar(&o.ChunkBytes, "chunk-bytes", 1<<20, "size of the pieces larger strings are written in")
+	return o
+}
+
+func parseTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, expected RFC 3339 such as 2006-01-02T15:04:05Z or unix seconds", s)
+	}
+	return t, nil
+}
+
+// parseArgs parses flags that may come before or after the positional
+// arguments, which it returns.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
@@ -0,0 +1,280 @@
+package psync
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReplayAOF replays an append only file into the dest endpoint, flushing it
+// first when flush is set. path is a single aof, which may start with an rdb
+// preamble, a redis 7 multi part manifest, or the directory holding one.
+func ReplayAOF(path, dest string, flush bool, opts LoadOptions) error {
+	r, err := parseURI(dest)
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+	files, err := aofFiles(path)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSink(ctx, r)
+	err = s.connect()
+	if err != nil {
+		return err
+	}
+	go s.run()
+	defer s.disconnect()
+	if flush {
+		s.send("FLUSHALL")
+		s.send("FUNCTION", "FLUSH")
+	}
+	for i, f := range files {
+		err = replayFile(ctx, s, r, f, i == len(files)-1, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return s.drain()
+}
+
+// aofFiles resolves path to the files to replay, in order.
+func aofFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open aof: %w", err)
+	}
+	if info.IsDir() {
+		manifests, err := filepath.Glob(filepath.Join(path, "*.manifest"))
+		if err != nil {
+			return nil, err
+		}
+		if len(manifests) != 1 {
+			return nil, fmt.Errorf("expected one aof manifest in %s, found %d", path, len(manifests))
+		}
+		path = manifests[0]
+	}
+	if strings.HasSuffix(path, ".manifest") {
+		return readManifest(path)
+	}
+	return []string{path}, nil
+}
+
+type manifestEntry struct {
+	name string
+	seq  int
+	typ  string
+}
+
+// readManifest returns the base file followed by the incremental files of a
+// multi part aof manifest, history files are left out.
+func readManifest(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open aof manifest: %w", err)
+	}
+	defer f.Close()
+
+	var base []string
+	var incr []manifestEntry
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		e, err := parseManifestLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aof manifest %s line %d: %w", path, n, err)
+		}
+		e.name = filepath.Join(filepath.Dir(path), e.name)
+		switch e.typ {
+		case "b":
+			base = append(base, e.name)
+		case "i":
+			incr = append(incr, e)
+		case "h":
+		default:
+			return nil, fmt.Errorf("invalid aof manifest %s line %d: unknown file type %q", path, n, e.typ)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read aof manifest: %w", err)
+	}
+	if len(base) > 1 {
+		return nil, fmt.Errorf("invalid aof manifest %s: %d base files", path, len(base))
+	}
+	sort.Slice(incr, func(i, j int) bool {
+		return incr[i].seq < incr[j].seq
+	})
+	files := base
+	for _, e := range incr {
+		files = append(files, e.name)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("aof manifest %s lists no files", path)
+	}
+	return files, nil
+}
+
+// parseManifestLine parses "file <name> seq <n> type <b|h|i>", where the
+// name may be quoted.
+func parseManifestLine(line string) (manifestEntry, error) {
+	var e manifestEntry
+	args, err := splitArgs(line)
+	if err != nil {
+		return e, err
+	}
+	if len(args)%2 != 0 {
+		return e, fmt.Errorf("odd number of fields")
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch args[i] {
+		case "file":
+			e.name = args[i+1]
+		case "seq":
+			e.seq, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return e, fmt.Errorf("invalid seq %q", args[i+1])
+			}
+		case "type":
+			e.typ = args[i+1]
+		}
+	}
+	if e.name == "" || e.typ == "" {
+		return e, fmt.Errorf("missing file name or type")
+	}
+	return e, nil
+}
+
+// splitArgs splits line on spaces, unquoting double quoted fields the way
+// redis quotes them.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] != '"' {
+			i := strings.IndexAny(line, " \t")
+			if i < 0 {
+				i = len(line)
+			}
+			args = append(args, line[:i])
+			line = line[i:]
+			continue
+		}
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return nil, fmt.Errorf("unbalanced quotes")
+		}
+		arg, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted field %s", line[:end+1])
+		}
+		args = append(args, arg)
+		line = line[end+1:]
+	}
+}
+
+// replayFile loads the rdb preamble of the aof at path, if it has one, and
+// writes its commands to the sink. A truncated command at the end of the last
+// file is dropped with a warning, the way redis does with
+// aof-load-truncated.
+func replayFile(ctx context.Context, s *sink, dest *redis, path string, last bool, opts LoadOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open aof: %w", err)
+	}
+	defer f.Close()
+	fmt.Printf("replaying %s\n", path)
+
+	buf := bufio.NewReader(f)
+	head, err := buf.Peek(5)
+	if err == nil && string(head) == "REDIS" {
+		// the preamble goes through its own connection, so everything
+		// before it has to be applied first
+		err = s.drain()
+		if err != nil {
+			return err
+		}
+		err = loadRDB(ctx, buf, dest, -1, nil, opts)
+		if err != nil {
+			return fmt.Errorf("failed to load rdb preamble of %s: %w", path, err)
+		}
+	}
+
+	r := &aofReader{r: &reader{buf: buf}}
+	var n int
+	for {
+		cmd, err := r.readCommand()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if last && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+				fmt.Printf("%s ends with a truncated command after %d commands, ignoring it\n", path, n)
+				break
+			}
+			return fmt.Errorf("failed to read command %d of %s: %w", n+1, path, err)
+		}
+		// archive segments also hold the GETACKs of the replication stream
+		if len(cmd.args) == 0 || cmd.is("REPLCONF") {
+			continue
+		}
+		err = s.write(cmd, -1)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	fmt.Printf("replayed %d commands from %s\n", n, path)
+	return nil
+}
+
+// aofReader reads the commands of an aof, skipping the annotations redis
+// writes on lines starting with '#' but keeping the last "#TS:" timestamp.
+type aofReader struct {
+	r  *reader
+	ts int64
+}
+
+// readCommand returns the next command, or io.EOF at the end of the aof.
+func (a *aofReader) readCommand() (*command, error) {
+	for {
+		b, err := a.r.buf.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '#' {
+			return a.r.readCommand()
+		}
+		line, err := a.r.readLine()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read annotation: %w", io.ErrUnexpectedEOF)
+		}
+		if strings.HasPrefix(line, "#TS:") {
+			ts, err := strconv.ParseInt(strings.TrimSpace(line[4:]), 10, 64)
+			if err == nil {
+				a.ts = ts
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package psync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseManifestLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want manifestEntry
+	}{
+		{
+			line: "file appendonly.aof.1.base.rdb seq 1 type b",
+			want: manifestEntry{name: "appendonly.aof.1.base.rdb", seq: 1, typ: "b"},
+		},
+		{
+			line: `file "my aof.3.incr.aof" seq 3 type i`,
+			want: manifestEntry{name: "my aof.3.incr.aof", seq: 3, typ: "i"},
+		},
+		{
+			line: `file "a\"b\\c\x01\n.aof" seq 2 type h`,
+			want: manifestEntry{name: "a\"b\\c\x01\n.aof", seq: 2, typ: "h"},
+		},
+		{
+			line: "seq 4\ttype i   file appendonly.aof.4.incr.aof",
+			want: manifestEntry{name: "appendonly.aof.4.incr.aof", seq: 4, typ: "i"},
+		},
+		{
+			line: `file "" seq 1 type b file "x y.aof"`,
+			want: manifestEntry{name: "x y.aof", seq: 1, typ: "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := parseManifestLine(tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseManifestLineErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`file "appendonly.aof seq 1 type b`, "unbalanced quotes"},
+		{`file "appendonly.aof\" seq 1 type b`, "unbalanced quotes"},
+		{`file "bad\q.aof" seq 1 type b`, "invalid quoted field"},
+		{"file appendonly.aof seq 1 type", "odd number of fields"},
+		{"file appendonly.aof seq one type b", "invalid seq"},
+		{"file appendonly.aof seq 1", "missing file name or type"},
+		{"seq 1 type b", "missing file name or type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			_, err := parseManifestLine(tt.line)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "psink-aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		manifest string
+		want     []string
+		err      string
+	}{
+		{
+			name: "base and incremental files",
+			manifest: "# written by redis\n" +
+				"file appendonly.aof.1.base.rdb seq 1 type b\n" +
+				"\n" +
+				`file "appendonly.aof.10.incr.aof" seq 10 type i` + "\n" +
+				"file appendonly.aof.0.base.aof seq 0 type h\n" +
+				`file "append only.aof.2.incr.aof" seq 2 type i` + "\n",
+			want: []string{"appendonly.aof.1.base.rdb", "append only.aof.2.incr.aof", "appendonly.aof.10.incr.aof"},
+		},
+		{
+			name:     "incremental files only",
+			manifest: "file appendonly.aof.1.incr.aof seq 1 type i\n",
+			want:     []string{"appendonly.aof.1.incr.aof"},
+		},
+		{
+			name:     "two base files",
+			manifest: "file a.rdb seq 1 type b\nfile b.rdb seq 2 type b\n",
+			err:      "2 base files",
+		},
+		{
+			name:     "unknown type",
+			manifest: "file a.rdb seq 1 type x\n",
+			err:      `line 1: unknown file type "x"`,
+		},
+		{
+			name:     "invalid line",
+			manifest: "# comment\nfile \"a.rdb seq 1 type b\n",
+			err:      "line 2: unbalanced quotes",
+		},
+		{
+			name:     "only history",
+			manifest: "file a.rdb seq 1 type h\n",
+			err:      "lists no files",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Repeat("m", i+1)+".manifest")
+			err := ioutil.WriteFile(path, []byte(tt.manifest), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := readManifest(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, name := range tt.want {
+				want = append(want, filepath.Join(dir, name))
+			}
+			if !reflect.DeepEqual(files, want) {
+				t.Errorf("got %q, want %q", files, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package psync
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveOptions control the rotation and retention of archive segments, zero
+// values disable the respective limit.
+type ArchiveOptions struct {
+	// SegmentSize is the size after which a segment is rotated
+	SegmentSize int64
+	// SegmentAge is how long a segment is written to before it is rotated
+	SegmentAge time.Duration
+	// RetainSegments is how many segments are kept, including the current
+	RetainSegments int
+	// RetainAge is how long segments are kept after they were last written
+	RetainAge time.Duration
+}
+
+// archive appends the replication stream verbatim to segment files named
+//
+//	psink-<unix time in ms>-<replid>-<start offset>.aof
+//
+// so the replication offset of every command follows from its position in
+// the segment. Like an aof with aof-timestamp-enabled, "#TS:<unix time>"
+// annotations record when the commands after them arrived.
+type archive struct {
+	dir  string
+	opts ArchiveOptions
+
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	replID string
+	// next is the offset the segment continues at
+	next    int64
+	size    int64
+	opened  time.Time
+	stamped int64
+}
+
+func newArchive(dir string, opts ArchiveOptions) (*archive, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	return &archive{
+		dir:  dir,
+		opts: opts,
+	}, nil
+}
+
+// write archives cmd, which starts at offset of the replication stream replID.
+func (a *archive) write(replID string, offset int64, cmd *command) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.file == nil || replID != a.replID || offset != a.next || a.full(now) {
+		err := a.rotate(replID, offset, now)
+		if err != nil {
+			return err
+		}
+	}
+	if now.Unix() != a.stamped {
+		a.stamped = now.Unix()
+		n, _ := fmt.Fprintf(a.w, "#TS:%d\r\n", a.stamped)
+		a.size += int64(n)
+	}
+	_, err := a.w.Write(cmd.raw)
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	a.size += int64(cmd.len())
+	a.next = offset + int64(cmd.len())
+	return nil
+}
+
+func (a *archive) full(now time.Time) bool {
+	if a.opts.SegmentSize > 0 && a.size >= a.opts.SegmentSize {
+		return true
+	}
+	return a.opts.SegmentAge > 0 && now.Sub(a.opened) >= a.opts.SegmentAge
+}
+
+// rotate closes the current segment and starts a new one at offset.
+func (a *archive) rotate(replID string, offset int64, now time.Time) error {
+	err := a.closeSegment()
+	if err != nil {
+		return err
+	}
+	// names have to order segments even when they are rotated within a
+	// millisecond
+	ms := now.UnixNano() / int64(time.Millisecond)
+	if last := a.opened.UnixNano() / int64(time.Millisecond); !a.opened.IsZero() && ms <= last {
+		ms = last + 1
+	}
+	now = time.Unix(0, ms*int64(time.Millisecond))
+	name := filepath.Join(a.dir, fmt.Sprintf("psink-%d-%s-%d.aof", ms, replID, offset))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create archive segment: %w", err)
+	}
+	fmt.Printf("archiving replication stream from offset %d to %s\n", offset, name)
+	a.file = f
+	a.w = bufio.NewWriter(f)
+	a.replID = replID
+	a.next = offset
+	a.size = 0
+	a.opened = now
+	a.stamped = 0
+	a.expire()
+	return nil
+}
+
+func (a *archive) closeSegment() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.w.Flush()
+	if err == nil {
+		err = a.file.Sync()
+	}
+	cerr := a.file.Close()
+	if err == nil {
+		err = cerr
+	}
+	a.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close archive segment: %w", err)
+	}
+	return nil
+}
+
+// flush writes buffered commands to the current segment.
+func (a *archive) flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.w.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+func (a *archive) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closeSegment()
+}
+
+// expire removes the segments that are past the retention limits, the
+// current segment always stays.
+func (a *archive) expire() {
+	if a.opts.RetainSegments <= 0 && a.opts.RetainAge <= 0 {
+		return
+	}
+	segments, err := listSegments(a.dir)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for i, s := range segments {
+		if s.path == a.file.Name() {
+			continue
+		}
+		remove := a.opts.RetainSegments > 0 && len(segments)-i > a.opts.RetainSegments
+		if !remove && a.opts.RetainAge > 0 {
+			info, err := os.Stat(s.path)
+			remove = err == nil && time.Since(info.ModTime()) > a.opts.RetainAge
+		}
+		if !remove {
+			continue
+		}
+		err = os.Remove(s.path)
+		if err != nil {
+			fmt.Println("failed to remove archive segment:", err)
+			continue
+		}
+		fmt.Printf("removed archive segment %s\n", s.path)
+	}
+}
+
+// segment is an archive file and the position of its first command.
+type segment struct {
+	path   string
+	time   time.Time
+	replID string
+	offset int64
+}
+
+// listSegments returns the archive segments in dir, oldest first.
+func listSegments(dir string) ([]segment, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archive: %w", err)
+	}
+	var segments []segment
+	for _, f := range files {
+		s, ok := parseSegmentName(f.Name())
+		if !ok || f.IsDir() {
+			continue
+		}
+		s.path = filepath.Join(dir, f.Name())
+		segments = append(segments, s)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].time.Before(segments[j].time)
+	})
+	return segments, nil
+}
+
+func parseSegmentName(name string) (segment, bool) {
+	var s segment
+	if !strings.HasPrefix(name, "psink-") || !strings.HasSuffix(name, ".aof") {
+		return s, false
+	}
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "psink-"), ".aof"), "-")
+	if len(parts) != 3 {
+		return s, false
+	}
+	ms, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return s, false
+	}
+	s.offset, err = strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return s, false
+	}
+	s.time = time.Unix(0, ms*int64(time.Millisecond))
+	s.replID = parts[1]
+	return s, true
+}
@@ -0,0 +1,42 @@
+package psync
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// backoff produces exponentially growing delays between min and max with
+// jitter, so that many psinks don't reconnect to a source in lockstep.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 && b.min<<uint(b.attempt) < b.max {
+		d = b.min << uint(b.attempt)
+	}
+	b.attempt++
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// errBusy marks replies of a source that cannot serve replicas right now,
+// e.g. because it is still loading its dataset after a restart.
+var errBusy = errors.New("source is busy")
+
+// isRetryable reports whether err was caused by a broken or timed out
+// connection or a busy source, as opposed to a protocol or data error that a
+// retry won't fix. Values of the rdb that end early are errTruncated rather
+// than io.EOF for that reason.
+func isRetryable(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errBusy)
+}
@@ -0,0 +1,63 @@
+package psync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpoint is the replication position persisted between runs so that a
+// restarted psink can attempt a partial resync.
+type checkpoint struct {
+	ReplID string    `json:"repl_id"`
+	Offset int64     `json:"offset"`
+	Time   time.Time `json:"time"`
+}
+
+func readCheckpoint(path string) (*checkpoint, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %w", path, err)
+	}
+	c := &checkpoint{}
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// writeCheckpoint replaces the checkpoint at path atomically by writing to a
+// temporary file in the same directory and renaming it over the old one.
+func writeCheckpoint(path string, c *checkpoint) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to replace checkpoint %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package psync
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+const (
+	defaultChunkSize  = 1000
+	defaultChunkBytes = 1 << 20
+)
+
+// chunker writes the elements of a value in commands of at most ChunkSize
+// elements, so neither psink nor the destination has to hold a huge value in
+// one piece. A value that takes more than one command is built under a
+// temporary key and renamed into place once it is complete, so the key
+// appears atomically and replaces any previous value safely.
+type chunker struct {
+	r   *rdb
+	cmd string
+	key []byte
+	// target is the key the commands write to
+	target []byte
+	// each sends one command per element instead of one for all of them
+	each    bool
+	elems   [][]interface{}
+	chunked bool
+	done    bool
+	// n is the length reported by RPUSH or the sum of elements added
+	n int
+}
+
+func (r *rdb) newChunker(cmd string, key []byte) *chunker {
+	return &chunker{
+		r:      r,
+		cmd:    cmd,
+		key:    key,
+		target: key,
+	}
+}
+
+func (r *rdb) chunkSize() int {
+	if r.opts.ChunkSize > 0 {
+		return r.opts.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+func (r *rdb) chunkBytes() int {
+	if r.opts.ChunkBytes > 0 {
+		return r.opts.ChunkBytes
+	}
+	return defaultChunkBytes
+}
+
+// tmpKey is where a value is built until it is complete. A random suffix
+// keeps it from colliding with the keys of the rdb, and it hashes to the slot
+// of key so it can be renamed to it on a cluster.
+func tmpKey(key []byte) ([]byte, error) {
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to name temporary key: %w", err)
+	}
+	var tmp []byte
+	if hashTag(key) == nil {
+		tmp = append(append([]byte("{"), slotTag(keySlot(key))...), '}')
+	}
+	tmp = append(append(tmp, key...), ":psink-tmp-"...)
+	return append(tmp, hex.EncodeToString(suffix)...), nil
+}
+
+// add queues an element made of args and writes a chunk once enough are
+// queued.
+func (c *chunker) add(args ...interface{}) error {
+	c.elems = append(c.elems, args)
+	if len(c.elems) < c.r.chunkSize() {
+		return nil
+	}
+	if !c.chunked {
+		tmp, err := tmpKey(c.key)
+		if err != nil {
+			return err
+		}
+		c.chunked = true
+		c.target = tmp
+	}
+	return c.flush(false)
+}
+
+// addEach queues every item as an element of its own.
+func (c *chunker) addEach(items [][]byte) error {
+	for _, item := range items {
+		err := c.add(item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addAll writes items to key with cmd, in chunks.
+func (r *rdb) addAll(cmd string, key []byte, items [][]byte) (int, error) {
+	c := r.newChunker(cmd, key)
+	defer c.abort()
+	err := c.addEach(items)
+	if err != nil {
+		return 0, err
+	}
+	return c.close()
+}
+
+// flush writes the queued elements. The last write of a value that fits in
+// one chunk replaces the key in a transaction.
+func (c *chunker) flush(last bool) error {
+	replace := last && !c.chunked
+	if len(c.elems) == 0 && !replace {
+		return nil
+	}
+	var err error
+	if replace {
+		err = c.r.conn.Send("MULTI")
+		if err == nil {
+			err = c.r.conn.Send("DEL", c.key)
+		}
+	}
+	if err == nil && c.each {
+		for _, args := range c.elems {
+			err = c.r.conn.Send(c.cmd, redigo.Args{}.Add(c.target).Add(args...)...)
+			if err != nil {
+				break
+			}
+		}
+	} else if err == nil && len(c.elems) > 0 {
+		args := redigo.Args{}.Add(c.target)
+		for _, elem := range c.elems {
+			args = args.Add(elem...)
+		}
+		err = c.r.conn.Send(c.cmd, args...)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %s %s: %w", c.cmd, c.key, err)
+	}
+	var replies []interface{}
+	if replace {
+		replies, err = redigo.Values(c.r.conn.Do("EXEC"))
+		if err == nil {
+			// the reply of DEL
+			replies = replies[1:]
+		}
+	} else {
+		replies, err = redigo.Values(c.r.conn.Do(""))
+	}
+	if err == nil {
+		err = pipelineError(replies)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %s %s: %w", c.cmd, c.key, err)
+	}
+	for _, reply := range replies {
+		if c.each {
+			c.n++
+			continue
+		}
+		n, _ := redigo.Int(reply, nil)
+		if c.cmd == "RPUSH" {
+			c.n = n
+		} else {
+			c.n += n
+		}
+	}
+	c.elems = c.elems[:0]
+	return nil
+}
+
+// close writes the remaining elements and moves a chunked value into place.
+// It returns the length reported by RPUSH, the number of elements added, or
+// of commands sent per element.
+func (c *chunker) close() (int, error) {
+	err := c.flush(true)
+	if err != nil {
+		return c.n, err
+	}
+	if c.chunked {
+		_, err = c.r.conn.Do("RENAME", c.target, c.key)
+		if err != nil {
+			return c.n, fmt.Errorf("failed to move %s into place: %w", c.key, err)
+		}
+	}
+	c.done = true
+	return c.n, nil
+}
+
+// abort removes the temporary key of a value that couldn't be completed.
+func (c *chunker) abort() {
+	if c.done || !c.chunked {
+		return
+	}
+	_, err := c.r.conn.Do("DEL", c.target)
+	if err != nil {
+		fmt.Printf("failed to remove %s: %v\n", c.target, err)
+	}
+}
+
+// loadStringValue sets a string. One larger than ChunkBytes is appended in
+// pieces of that size under a temporary key, without reading all of it into
+// memory unless it is compressed.
+func (r *rdb) loadStringValue(key []byte) error {
+	length, encoded, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	size := r.chunkBytes()
+	if !encoded && length > uint64(size) {
+		return r.appendChunks(key, int(length), r.readFull)
+	}
+	val, err := r.loadStringBody(length, encoded)
+	if err != nil {
+		return err
+	}
+	if len(val) > size {
+		return r.appendChunks(key, len(val), func(b []byte) error {
+			val = val[copy(b, val):]
+			return nil
+		})
+	}
+	res, err := redigo.String(r.conn.Do("SET", key, val))
+	if err != nil || res != "OK" {
+		return fmt.Errorf("failed to SET val %s, %s: %w", key, val, err)
+	}
+	return nil
+}
+
+// appendChunks builds a string of length bytes, filled by read, with APPEND.
+func (r *rdb) appendChunks(key []byte, length int, read func([]byte) error) error {
+	tmp, err := tmpKey(key)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, r.chunkBytes())
+	for length > 0 {
+		chunk := buf
+		if length < len(chunk) {
+			chunk = chunk[:length]
+		}
+		err = read(chunk)
+		if err == nil {
+			_, err = r.conn.Do("APPEND", tmp, chunk)
+		}
+		if err != nil {
+			r.conn.Do("DEL", tmp)
+			return fmt.Errorf("failed to APPEND %s: %w", key, err)
+		}
+		length -= len(chunk)
+	}
+	_, err = r.conn.Do("RENAME", tmp, key)
+	if err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package psync
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+)
+
+// crc16 is the XMODEM crc redis cluster hashes keys to slots with.
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// hashTag returns the part of key between the first { and the following },
+// which is hashed instead of the whole key when it is not empty.
+func hashTag(key []byte) []byte {
+	start := bytes.IndexByte(key, '{')
+	if start < 0 {
+		return nil
+	}
+	end := bytes.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return nil
+	}
+	return key[start+1 : start+1+end]
+}
+
+func keySlot(key []byte) uint16 {
+	if tag := hashTag(key); tag != nil {
+		return crc16(tag) % 16384
+	}
+	return crc16(key) % 16384
+}
+
+var (
+	slotTagsOnce sync.Once
+	slotTags     [16384][]byte
+)
+
+// slotTag returns a hash tag for slot, so other keys can be placed in the
+// slot of a key without one.
+func slotTag(slot uint16) []byte {
+	slotTagsOnce.Do(func() {
+		for i, left := 0, len(slotTags); left > 0; i++ {
+			tag := []byte(strconv.Itoa(i))
+			s := crc16(tag) % 16384
+			if slotTags[s] == nil {
+				slotTags[s] = tag
+				left--
+			}
+		}
+	})
+	return slotTags[slot]
+}
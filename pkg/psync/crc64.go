@@ -0,0 +1,51 @@
+package psync
+
+import (
+	"encoding/binary"
+	"hash/crc64"
+)
+
+// crcTable is the reflected Jones polynomial redis uses for rdb checksums.
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Update extends crc over p the way redis does, which unlike hash/crc64
+// neither inverts the initial value nor the result.
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
+
+// crc64UpdateByte extends crc by a single byte.
+func crc64UpdateByte(crc uint64, b byte) uint64 {
+	return crcTable[byte(crc)^b] ^ crc>>8
+}
+
+// checksumWriter computes the crc64 of everything written to it except the
+// trailing 8 bytes, which in an rdb are the checksum itself.
+type checksumWriter struct {
+	crc  uint64
+	tail []byte
+}
+
+func (c *checksumWriter) Write(b []byte) (int, error) {
+	buf := append(c.tail, b...)
+	if len(buf) <= 8 {
+		c.tail = buf
+		return len(b), nil
+	}
+	c.crc = crc64Update(c.crc, buf[:len(buf)-8])
+	c.tail = append([]byte(nil), buf[len(buf)-8:]...)
+	return len(b), nil
+}
+
+// verify reports whether the trailing checksum matches, and whether there was
+// one at all, rdbs saved with rdbchecksum no carry zero instead.
+func (c *checksumWriter) verify() (ok bool, present bool) {
+	if len(c.tail) != 8 {
+		return false, true
+	}
+	expected := binary.LittleEndian.Uint64(c.tail)
+	if expected == 0 {
+		return true, false
+	}
+	return expected == c.crc, true
+}
@@ -2,11 +2,16 @@ package psync
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"strconv"
 )
 
+// errTruncated is returned when a value encoded in a string of the rdb ends
+// early. Unlike io.EOF it doesn't pass for a broken connection, retrying the
+// sync won't fix a corrupt rdb.
+var errTruncated = errors.New("encoded value is truncated")
+
 type input struct {
 	data  []byte
 	index int
@@ -19,8 +24,8 @@ func newInput(data []byte) *input {
 }
 
 func (buf *input) Slice(n int) ([]byte, error) {
-	if buf.index+n > len(buf.data) {
-		return nil, io.EOF
+	if n < 0 || buf.index+n > len(buf.data) {
+		return nil, errTruncated
 	}
 	b := buf.data[buf.index : buf.index+n]
 	buf.index = buf.index + n
@@ -29,7 +34,7 @@ func (buf *input) Slice(n int) ([]byte, error) {
 
 func (buf *input) ReadByte() (byte, error) {
 	if buf.index >= len(buf.data) {
-		return 0, io.EOF
+		return 0, errTruncated
 	}
 	b := buf.data[buf.index]
 	buf.index++
@@ -41,7 +46,7 @@ func (buf *input) Read(b []byte) (int, error) {
 		return 0, nil
 	}
 	if buf.index >= len(buf.data) {
-		return 0, io.EOF
+		return 0, errTruncated
 	}
 	n := copy(b, buf.data[buf.index:])
 	buf.index = buf.index + n
@@ -191,10 +196,11 @@ func loadZiplistEntry(buf *input) ([]byte, error) {
 		return []byte(strconv.FormatInt(int64(binary.LittleEndian.Uint64(intBytes)), 10)), nil
 	case header == ZipInt24B:
 		intBytes := make([]byte, 4)
-		_, err := buf.Read(intBytes[1:])
+		b, err := buf.Slice(3)
 		if err != nil {
 			return nil, err
 		}
+		copy(intBytes[1:], b)
 		return []byte(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(intBytes))>>8), 10)), nil
 	case header>>4 == ZipInt04B:
 		return []byte(strconv.FormatInt(int64(header&0x0f)-1, 10)), nil
@@ -202,3 +208,100 @@ func loadZiplistEntry(buf *input) ([]byte, error) {
 
 	return nil, fmt.Errorf("rdb: unknown ziplist header byte: %d", header)
 }
+
+func loadListpackLength(buf *input) (int64, error) {
+	buf.Seek(4, 0) // skip the total bytes
+	lenBytes, err := buf.Slice(2)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint16(lenBytes)), nil
+}
+
+// errListpackEnd is returned at the terminator of a listpack
+var errListpackEnd = errors.New("end of listpack")
+
+// loadListpackEntry returns the next entry of a listpack or errListpackEnd at
+// its terminator.
+func loadListpackEntry(buf *input) ([]byte, error) {
+	header, err := buf.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var val []byte
+	var size int
+	switch {
+	case header>>7 == 0:
+		val, size = []byte(strconv.FormatInt(int64(header&0x7f), 10)), 1
+	case header>>6 == 2:
+		size = int(header & 0x3f)
+		val, err = buf.Slice(size)
+		size++
+	case header>>5 == 6:
+		b, err := buf.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		v := int64(header&0x1f)<<8 | int64(b)
+		if v >= 1<<12 {
+			v -= 1 << 13
+		}
+		val, size = []byte(strconv.FormatInt(v, 10)), 2
+	case header>>4 == 14:
+		b, err := buf.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		size = int(header&0x0f)<<8 | int(b)
+		val, err = buf.Slice(size)
+		if err != nil {
+			return nil, err
+		}
+		size += 2
+	case header == 0xf0:
+		lenBytes, err := buf.Slice(4)
+		if err != nil {
+			return nil, err
+		}
+		size = int(binary.LittleEndian.Uint32(lenBytes))
+		val, err = buf.Slice(size)
+		if err != nil {
+			return nil, err
+		}
+		size += 5
+	case header >= 0xf1 && header <= 0xf4:
+		n := map[byte]int{0xf1: 2, 0xf2: 3, 0xf3: 4, 0xf4: 8}[header]
+		intBytes, err := buf.Slice(n)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, 8)
+		copy(b[8-n:], intBytes)
+		// shift the sign bit into place
+		v := int64(binary.LittleEndian.Uint64(b)) >> uint(8*(8-n))
+		val, size = []byte(strconv.FormatInt(v, 10)), n+1
+	case header == 0xff:
+		return nil, errListpackEnd
+	default:
+		return nil, fmt.Errorf("rdb: unknown listpack header byte: %d", header)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// skip the backlen, the size of the entry in 7 bit groups
+	var backlen int64
+	switch {
+	case size <= 127:
+		backlen = 1
+	case size < 16383:
+		backlen = 2
+	case size < 2097151:
+		backlen = 3
+	case size < 268435455:
+		backlen = 4
+	default:
+		backlen = 5
+	}
+	_, err = buf.Slice(int(backlen))
+	return val, err
+}
@@ -0,0 +1,128 @@
+package psync
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// lpEntry appends the backlen of an encoded listpack entry, as redis writes
+// it, in 7 bit groups read from the right.
+func lpEntry(enc ...byte) []byte {
+	l := len(enc)
+	switch {
+	case l <= 127:
+		return append(enc, byte(l))
+	case l < 16383:
+		return append(enc, byte(l>>7), byte(l&127)|128)
+	}
+	return append(enc, byte(l>>14), byte((l>>7)&127)|128, byte(l&127)|128)
+}
+
+// listpack frames entries with the total size and count header and the
+// terminator.
+func listpack(entries ...[]byte) []byte {
+	lp := make([]byte, 6)
+	for _, e := range entries {
+		lp = append(lp, e...)
+	}
+	lp = append(lp, 0xff)
+	binary.LittleEndian.PutUint32(lp, uint32(len(lp)))
+	binary.LittleEndian.PutUint16(lp[4:], uint16(len(entries)))
+	return lp
+}
+
+func lpString(s string) []byte {
+	switch {
+	case len(s) < 64:
+		return lpEntry(append([]byte{0x80 | byte(len(s))}, s...)...)
+	case len(s) < 4096:
+		return lpEntry(append([]byte{0xe0 | byte(len(s)>>8), byte(len(s))}, s...)...)
+	}
+	enc := []byte{0xf0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(enc[1:], uint32(len(s)))
+	return lpEntry(append(enc, s...)...)
+}
+
+func TestListpackEntries(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry []byte
+		want  string
+	}{
+		{"7 bit uint", lpEntry(0x7f), "127"},
+		{"7 bit zero", lpEntry(0x00), "0"},
+		{"6 bit string", lpString("abc"), "abc"},
+		{"empty string", lpString(""), ""},
+		{"13 bit int", lpEntry(0xc0|0x0f, 0xa0), "4000"},
+		{"13 bit negative int", lpEntry(0xdf, 0xff), "-1"},
+		{"12 bit string", lpString(strings.Repeat("a", 70)), strings.Repeat("a", 70)},
+		{"12 bit string with 2 byte backlen", lpString(strings.Repeat("b", 200)), strings.Repeat("b", 200)},
+		{"32 bit string", lpString(strings.Repeat("c", 5000)), strings.Repeat("c", 5000)},
+		{"16 bit int", lpEntry(0xf1, 0xd4, 0xfe), "-300"},
+		{"24 bit int", lpEntry(0xf2, 0x00, 0x00, 0x10), "1048576"},
+		{"24 bit negative int", lpEntry(0xf2, 0xff, 0xff, 0xff), "-1"},
+		{"32 bit int", lpEntry(0xf3, 0x00, 0x00, 0x00, 0x80), "-2147483648"},
+		{"64 bit int", lpEntry(0xf4, 0, 0, 0, 0, 0, 1, 0, 0), "1099511627776"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a second entry checks the backlen was skipped exactly
+			buf := newInput(listpack(tt.entry, lpString("next")))
+			n, err := loadListpackLength(buf)
+			if err != nil || n != 2 {
+				t.Fatalf("got length %d, %v", n, err)
+			}
+			got, err := loadListpackEntry(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			got, err = loadListpackEntry(buf)
+			if err != nil || string(got) != "next" {
+				t.Fatalf("got %q, %v after the entry", got, err)
+			}
+			_, err = loadListpackEntry(buf)
+			if err != errListpackEnd {
+				t.Errorf("got %v at the terminator, want %v", err, errListpackEnd)
+			}
+		})
+	}
+}
+
+func TestListpackTruncated(t *testing.T) {
+	lp := listpack(lpString("abc"), lpEntry(0xf3, 1, 2, 3, 4))
+	tests := []struct {
+		name string
+		lp   []byte
+	}{
+		{"header", lp[:5]},
+		{"string", lp[:8]},
+		{"backlen", lp[:10]},
+		{"int", lp[:13]},
+		{"terminator", lp[:len(lp)-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := newInput(tt.lp)
+			_, err := loadListpackLength(buf)
+			for err == nil {
+				_, err = loadListpackEntry(buf)
+			}
+			if err != errTruncated {
+				t.Errorf("got %v, want %v", err, errTruncated)
+			}
+		})
+	}
+}
+
+func TestListpackUnknownHeader(t *testing.T) {
+	buf := newInput(listpack(lpEntry(0xf5, 0)))
+	loadListpackLength(buf)
+	_, err := loadListpackEntry(buf)
+	if err == nil || err == errTruncated {
+		t.Errorf("got %v for an unknown encoding", err)
+	}
+}
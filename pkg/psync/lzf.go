@@ -1,11 +1,17 @@
 package psync
 
-func lzfDecompress(in []byte, inLen, outLen int) []byte {
+import "fmt"
+
+func lzfDecompress(in []byte, inLen, outLen int) ([]byte, error) {
 	out := make([]byte, outLen)
-	for i, o := 0, 0; i < inLen; {
+	o := 0
+	for i := 0; i < inLen; {
 		ctrl := int(in[i])
 		i++
 		if ctrl < 1<<5 {
+			if i+ctrl >= inLen || o+ctrl >= outLen {
+				return nil, fmt.Errorf("lzf: literal run out of range: %w", errTruncated)
+			}
 			for x := 0; x <= ctrl; x++ {
 				out[o] = in[i]
 				i++
@@ -14,11 +20,20 @@ func lzfDecompress(in []byte, inLen, outLen int) []byte {
 		} else {
 			length := ctrl >> 5
 			if length == 7 {
+				if i >= inLen {
+					return nil, fmt.Errorf("lzf: back reference out of range: %w", errTruncated)
+				}
 				length += int(in[i])
 				i++
 			}
+			if i >= inLen {
+				return nil, fmt.Errorf("lzf: back reference out of range: %w", errTruncated)
+			}
 			ref := o - ((ctrl & 0x1f) << 8) - int(in[i]) - 1
 			i++
+			if ref < 0 || o+length+1 >= outLen {
+				return nil, fmt.Errorf("lzf: back reference out of range: %w", errTruncated)
+			}
 			for x := 0; x <= length+1; x++ {
 				out[o] = out[ref]
 				ref++
@@ -26,6 +41,9 @@ func lzfDecompress(in []byte, inLen, outLen int) []byte {
 			}
 		}
 	}
+	if o != outLen {
+		return nil, fmt.Errorf("lzf: decompressed %d bytes instead of %d: %w", o, outLen, errTruncated)
+	}
 
-	return out
+	return out, nil
 }
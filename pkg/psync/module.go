@@ -0,0 +1,119 @@
+package psync
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// moduleCharset encodes the 9 character names of module types in their ids.
+const moduleCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// moduleName decodes the module type name from the upper 54 bits of a module
+// id, the lower 10 bits are the encoding version.
+func moduleName(id uint64) string {
+	name := make([]byte, 9)
+	id >>= 10
+	for i := len(name) - 1; i >= 0; i-- {
+		name[i] = moduleCharset[id&63]
+		id >>= 6
+	}
+	return string(name)
+}
+
+// loadModule recreates a module value with RESTORE, from a DUMP payload
+// built out of the raw bytes of the value. That only works when the module
+// is loaded on the destination, otherwise the key is skipped or the load
+// fails, depending on SkipModules.
+func (r *rdb) loadModule(key []byte, t byte, expire int64) error {
+	if t == TypeModule {
+		return fmt.Errorf("key %s is a module value in the format of redis 4.0 release candidates, which can't be parsed", key)
+	}
+	r.capture = []byte{t}
+	defer func() {
+		r.capture = nil
+	}()
+	id, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	name := moduleName(id)
+	err = r.skipModuleValue()
+	if err != nil {
+		return fmt.Errorf("failed to parse key %s of module %s: %w", key, name, err)
+	}
+	err = r.restore(key, r.capture, expire)
+	if err == nil {
+		return nil
+	}
+	if r.opts.SkipModules {
+		fmt.Printf("skipping key %s of module %s: %v\n", key, name, err)
+		r.skipped++
+		return nil
+	}
+	return fmt.Errorf("failed to restore key %s of module %s, load the module on the destination or skip module values: %w", key, name, err)
+}
+
+// skipModuleAux skips the global data of a module, which only the module
+// itself could restore.
+func (r *rdb) skipModuleAux() error {
+	id, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	opcode, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	if opcode != ModuleOpcodeUInt {
+		return fmt.Errorf("unexpected opcode %d for the aux data of module %s", opcode, moduleName(id))
+	}
+	// when the aux data was saved, before or after the keys
+	_, _, err = r.loadLen()
+	if err != nil {
+		return err
+	}
+	err = r.skipModuleValue()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("skipped aux data of module %s\n", moduleName(id))
+	return nil
+}
+
+// skipModuleValue reads the opcodes a module value is made of up to its EOF.
+func (r *rdb) skipModuleValue() error {
+	for {
+		opcode, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case ModuleOpcodeEOF:
+			return nil
+		case ModuleOpcodeSInt, ModuleOpcodeUInt:
+			_, _, err = r.loadLen()
+		case ModuleOpcodeFloat:
+			_, err = r.loadRaw(4)
+		case ModuleOpcodeDouble:
+			_, err = r.loadBinaryFloat()
+		case ModuleOpcodeString:
+			_, err = r.loadString()
+		default:
+			return fmt.Errorf("unknown module opcode %d", opcode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dumpPayload frames a serialized value the way DUMP does, followed by the
+// rdb version and a crc64 of it all.
+func dumpPayload(value []byte, version int) []byte {
+	payload := make([]byte, len(value), len(value)+10)
+	copy(payload, value)
+	payload = append(payload, byte(version), byte(version>>8))
+	crc := make([]byte, 8)
+	binary.LittleEndian.PutUint64(crc, crc64Update(0, payload))
+	return append(payload, crc...)
+}
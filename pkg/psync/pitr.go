@@ -0,0 +1,288 @@
+package psync
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RecoveryTarget is where point in time recovery stops. Replay ends before
+// the first command past Offset or, since the archive records arrival times
+// by the second, before the first command that arrived in the second of
+// Time. Zero values are not a target.
+type RecoveryTarget struct {
+	Time   time.Time
+	Offset int64
+}
+
+func (t RecoveryTarget) String() string {
+	if t.Time.IsZero() {
+		return fmt.Sprintf("offset %d", t.Offset)
+	}
+	if t.Offset <= 0 {
+		return t.Time.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s or offset %d", t.Time.Format(time.RFC3339), t.Offset)
+}
+
+// Recover restores the rdb snapshot into the dest endpoint, flushing it
+// first when flush is set, and replays the replication stream archived in
+// archiveDir from the offset of the snapshot up to target.
+func Recover(snapshot, archiveDir, dest string, target RecoveryTarget, flush bool, opts LoadOptions) error {
+	if target.Time.IsZero() && target.Offset <= 0 {
+		return fmt.Errorf("a recovery target time or offset is required")
+	}
+	r, err := parseURI(dest)
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+	info, err := readRDBInfo(snapshot)
+	if err != nil {
+		return err
+	}
+	if info.replID == "" {
+		return fmt.Errorf("snapshot %s has no replication id and offset, save it from a replication stream with -rdb-file", snapshot)
+	}
+	if !target.Time.IsZero() && info.ctime.After(target.Time) {
+		return fmt.Errorf("snapshot %s was taken at %s, after the recovery target", snapshot, info.ctime.Format(time.RFC3339))
+	}
+	if target.Offset > 0 && target.Offset < info.offset {
+		return fmt.Errorf("snapshot %s is at offset %d, after the recovery target", snapshot, info.offset)
+	}
+	segments, err := listSegments(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	err = Restore(snapshot, dest, flush, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("recovering from %s at offset %d to %s\n", info.replID, info.offset, target)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSink(ctx, r)
+	err = s.connect()
+	if err != nil {
+		return err
+	}
+	go s.run()
+	defer s.disconnect()
+	rec := &recovery{
+		sink:   s,
+		target: target,
+		replID: info.replID,
+		offset: info.offset,
+		// the snapshot alone recovers up to its offset
+		recovered: info.offset,
+	}
+	err = rec.replay(segments)
+	if err != nil {
+		return err
+	}
+	err = s.drain()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("recovered %d commands up to offset %d of %s\n", rec.applied, rec.recovered, rec.replID)
+	return nil
+}
+
+// recovery replays archive segments as one continuous replication stream.
+type recovery struct {
+	sink   *sink
+	target RecoveryTarget
+	// replID and offset are the position in the stream replayed up to
+	replID  string
+	offset  int64
+	started bool
+	// tx holds a transaction until its EXEC shows it ends before the target
+	tx []*command
+	// recovered is the offset after the last command applied
+	recovered int64
+	applied   int
+}
+
+var errTargetReached = errors.New("recovery target reached")
+
+func (rec *recovery) replay(segments []segment) error {
+	for _, seg := range segments {
+		if seg.replID != rec.replID {
+			// a partial resync can switch to the replication id of a
+			// promoted replica, keeping the offset
+			if !rec.started || seg.offset != rec.offset {
+				continue
+			}
+			rec.replID = seg.replID
+		}
+		if seg.offset > rec.offset {
+			if rec.started {
+				return fmt.Errorf("archive has a gap between offset %d and %d of %s, recover from a later snapshot", rec.offset, seg.offset, seg.replID)
+			}
+			continue
+		}
+		err := rec.replaySegment(seg)
+		if err == errTargetReached {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !rec.started {
+		return fmt.Errorf("archive has no segment of %s covering offset %d", rec.replID, rec.offset)
+	}
+	if rec.target.Offset > 0 && rec.offset >= rec.target.Offset {
+		return nil
+	}
+	if rec.target.Time.IsZero() {
+		return fmt.Errorf("archive ends at offset %d, before the recovery target", rec.offset)
+	}
+	fmt.Printf("archive ends at offset %d before reaching %s\n", rec.offset, rec.target)
+	return nil
+}
+
+// replaySegment applies the commands of seg that follow the current offset.
+func (rec *recovery) replaySegment(seg segment) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return fmt.Errorf("failed to open archive segment: %w", err)
+	}
+	defer f.Close()
+
+	r := &aofReader{r: newReader(f)}
+	pos := seg.offset
+	for {
+		cmd, err := r.readCommand()
+		if err != nil && err != io.EOF {
+			// psink stopped while writing the segment, the stream goes on
+			// in the next one
+			fmt.Printf("archive segment %s is truncated at offset %d: %v\n", seg.path, pos, err)
+		}
+		if err != nil {
+			// a segment that ends right at the offset covers it too
+			rec.started = rec.started || pos == rec.offset
+			return nil
+		}
+		start, end := pos, pos+int64(cmd.len())
+		pos = end
+		if end <= rec.offset {
+			continue
+		}
+		if start < rec.offset {
+			return fmt.Errorf("archive segment %s has no command starting at offset %d", seg.path, rec.offset)
+		}
+		if !rec.started {
+			fmt.Printf("replaying %s from offset %d\n", seg.path, start)
+			rec.started = true
+		}
+		if rec.reached(r.ts, end) {
+			if len(rec.tx) > 0 {
+				fmt.Printf("dropping transaction of %d commands that ends past the recovery target\n", len(rec.tx))
+			}
+			return errTargetReached
+		}
+		err = rec.apply(cmd, end)
+		if err != nil {
+			return err
+		}
+		rec.offset = end
+	}
+}
+
+// reached reports whether a command that arrived at ts and ends at end is
+// past the recovery target.
+func (rec *recovery) reached(ts, end int64) bool {
+	if rec.target.Offset > 0 && end > rec.target.Offset {
+		return true
+	}
+	return !rec.target.Time.IsZero() && ts >= rec.target.Time.Unix()
+}
+
+// apply writes cmd to the sink, holding back transactions until they are
+// complete so none is applied only partially.
+func (rec *recovery) apply(cmd *command, end int64) error {
+	if len(cmd.args) == 0 || cmd.is("REPLCONF") {
+		if len(rec.tx) == 0 {
+			rec.recovered = end
+		}
+		return nil
+	}
+	if cmd.is("MULTI") || len(rec.tx) > 0 {
+		rec.tx = append(rec.tx, cmd)
+		if !cmd.is("EXEC") && !cmd.is("DISCARD") {
+			return nil
+		}
+		tx := rec.tx
+		rec.tx = nil
+		for _, c := range tx {
+			err := rec.sink.write(c, -1)
+			if err != nil {
+				return err
+			}
+		}
+		rec.applied += len(tx)
+		rec.recovered = end
+		return nil
+	}
+	rec.applied++
+	rec.recovered = end
+	return rec.sink.write(cmd, -1)
+}
+
+// rdbInfo is what the aux fields of an rdb tell about its origin.
+type rdbInfo struct {
+	replID string
+	offset int64
+	ctime  time.Time
+}
+
+// readRDBInfo reads the aux fields at the start of the rdb file at path.
+func readRDBInfo(path string) (*rdbInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	r := &rdb{
+		ctx: context.Background(),
+		buf: bufio.NewReader(f),
+		n:   -1,
+	}
+	_, err = r.checkHeader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	info := &rdbInfo{}
+	for {
+		t, err := r.loadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if t != FlagOpcodeAux {
+			return info, nil
+		}
+		key, err := r.loadString()
+		if err != nil {
+			return nil, fmt.Errorf("parse Aux key failed: %w", err)
+		}
+		val, err := r.loadString()
+		if err != nil {
+			return nil, fmt.Errorf("parse Aux value failed: %w", err)
+		}
+		switch string(key) {
+		case "repl-id":
+			info.replID = string(val)
+		case "repl-offset":
+			info.offset, _ = strconv.ParseInt(string(val), 10, 64)
+		case "ctime":
+			ctime, _ := strconv.ParseInt(string(val), 10, 64)
+			info.ctime = time.Unix(ctime, 0)
+		}
+	}
+}
@@ -1,114 +1,619 @@
 package psync
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Psync struct {
 	ctx       context.Context
 	cancel    context.CancelFunc
 	src, dest *redis
+	sink      *sink
+
+	mu     sync.Mutex
+	replID string
+	offset int64
+
+	checkpoint         string
+	checkpointInterval time.Duration
+
+	retry       backoff
+	replTimeout time.Duration
+
+	spoolDir   string
+	spoolLimit int64
+	rdbFile    string
+
+	archiveDir  string
+	archiveOpts ArchiveOptions
+	archive     *archive
+
+	load LoadOptions
+}
+
+const (
+	// replTimeoutPings is how many ping periods of the source the
+	// replication stream may stay silent before the source is considered
+	// dead, with the default period of 10s this matches the default
+	// repl-timeout of redis
+	replTimeoutPings  = 6
+	defaultPingPeriod = 10 * time.Second
+
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+// Option configures optional Psync behaviour.
+type Option func(*Psync)
+
+// WithSourceAuth authenticates to the source with password, as user when it
+// is not empty.
+func WithSourceAuth(user, password string) Option {
+	return func(p *Psync) {
+		p.src.user = user
+		p.src.password = password
+	}
+}
+
+// WithDestAuth authenticates to the destination with password, as user when
+// it is not empty.
+func WithDestAuth(user, password string) Option {
+	return func(p *Psync) {
+		p.dest.user = user
+		p.dest.password = password
+	}
+}
+
+// WithSourceTLS connects to the source over TLS.
+func WithSourceTLS(config *tls.Config) Option {
+	return func(p *Psync) {
+		p.src.tls = config
+	}
+}
+
+// WithDestTLS connects to the destination over TLS.
+func WithDestTLS(config *tls.Config) Option {
+	return func(p *Psync) {
+		p.dest.tls = config
+	}
+}
+
+// WithSourceTimeouts configures the connection deadlines of the source.
+func WithSourceTimeouts(t Timeouts) Option {
+	return func(p *Psync) {
+		p.src.timeouts = t
+	}
+}
+
+// WithDestTimeouts configures the connection deadlines of the destination.
+func WithDestTimeouts(t Timeouts) Option {
+	return func(p *Psync) {
+		p.dest.timeouts = t
+	}
+}
+
+// WithReplTimeout fails the source connection once the replication stream
+// stays silent for d. It defaults to the read_timeout of the source, or else
+// replTimeoutPings ping periods of the source.
+func WithReplTimeout(d time.Duration) Option {
+	return func(p *Psync) {
+		p.replTimeout = d
+	}
+}
+
+// WithSpool downloads the rdb into dir before loading it and spools the
+// replication stream that arrives during the load into dir as well, so the
+// source doesn't have to buffer it. A positive limit bounds the spool size.
+func WithSpool(dir string, limit int64) Option {
+	return func(p *Psync) {
+		p.spoolDir = dir
+		p.spoolLimit = limit
+	}
+}
+
+// WithRDBFile saves the rdb of every full resync to path, after verifying its
+// checksum, so it can be kept as a backup or loaded again later.
+func WithRDBFile(path string) Option {
+	return func(p *Psync) {
+		p.rdbFile = path
+	}
+}
+
+// WithArchive appends the replication stream to rotating segment files in
+// dir, which together with an rdb file make a complete change history.
+func WithArchive(dir string, opts ArchiveOptions) Option {
+	return func(p *Psync) {
+		p.archiveDir = dir
+		p.archiveOpts = opts
+	}
+}
+
+// WithLoadOptions controls how the rdb of a full resync is loaded.
+func WithLoadOptions(opts LoadOptions) Option {
+	return func(p *Psync) {
+		p.load = opts
+	}
 }
 
-func New(srcAddr, destAddr string) *Psync {
+// WithCheckpoint persists the replication id and the offset applied to the
+// destination to path every interval, and resumes from it on startup.
+func WithCheckpoint(path string, interval time.Duration) Option {
+	return func(p *Psync) {
+		p.checkpoint = path
+		p.checkpointInterval = interval
+	}
+}
+
+// New prepares replication from the src to the dest endpoint. Both are
+// redis://, rediss:// or unix:// URIs, as described by parseURI.
+func New(src, dest string, opts ...Option) (*Psync, error) {
+	srcRedis, err := parseURI(src)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+	destRedis, err := parseURI(dest)
+	if err != nil {
+		return nil, fmt.Errorf("destination: %w", err)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Psync{
+	p := &Psync{
 		ctx:    ctx,
 		cancel: cancel,
-		src:    newRedis(srcAddr),
-		dest:   newRedis(destAddr),
+		src:    srcRedis,
+		dest:   destRedis,
+		replID: "?",
+		offset: -1,
+		retry:  backoff{min: minRetryDelay, max: maxRetryDelay},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.replTimeout != 0 && p.src.timeouts.Read != 0 && p.replTimeout != p.src.timeouts.Read {
+		return nil, fmt.Errorf("source: read_timeout %s conflicts with the replication timeout %s, set only one", p.src.timeouts.Read, p.replTimeout)
 	}
+	p.sink = newSink(ctx, p.dest)
+	return p, nil
 }
 
-func (p *Psync) Go() {
+// Go replicates from the source into the destination until it is stopped or
+// fails with an error that reconnecting to the source cannot fix.
+func (p *Psync) Go() error {
 	fmt.Println("starting Sync")
+	err := p.resume()
+	if err != nil {
+		return err
+	}
+	if p.archiveDir != "" {
+		p.archive, err = newArchive(p.archiveDir, p.archiveOpts)
+		if err != nil {
+			return err
+		}
+	}
 	defer p.cleanup()
-	err := p.src.connect(p.ctx)
+	err = p.sink.connect()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = p.dest.connect(p.ctx)
+	go p.sink.run()
+	if p.checkpoint != "" {
+		go p.checkpointLoop()
+	}
+	for {
+		err = p.replicate()
+		if p.ctx.Err() != nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		cerr := p.src.close()
+		if cerr != nil {
+			fmt.Println(cerr)
+		}
+		delay := p.retry.next()
+		fmt.Printf("lost source %s: %v, reconnecting in %s (attempt %d)\n", p.src, err, delay, p.retry.attempt)
+		select {
+		case <-p.ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// replicate connects to the source and replicates from it until the
+// connection breaks.
+func (p *Psync) replicate() error {
+	err := p.src.connect(p.ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	p.src.writer.ping()
-	_, err = p.src.reader.readLine()
+	_, err = p.src.reader.readStatus()
 	if err != nil {
-		panic("failed to read pong")
+		return fmt.Errorf("failed to read pong: %w", err)
 	}
-	go p.log(p.dest)
-	err = p.sync()
+	timeout := p.replTimeout
+	if timeout == 0 {
+		timeout = p.src.timeouts.Read
+	}
+	if timeout == 0 {
+		timeout = replTimeoutPings * p.pingPeriod()
+	}
+	// the source sends newlines while it prepares the rdb and pings during
+	// the stream, so from here on silence means it is gone
+	p.src.conn.read = timeout
+	return p.sync()
+}
+
+// pingPeriod asks the source how often it pings its replicas, falling back to
+// the redis default when CONFIG is not available.
+func (p *Psync) pingPeriod() time.Duration {
+	p.src.writer.raw(newCommand("CONFIG", "GET", "repl-ping-replica-period").raw)
+	reply, err := p.src.reader.readReply()
 	if err != nil {
-		panic(err)
+		return defaultPingPeriod
+	}
+	// *2 $24 repl-ping-replica-period $<n> <period>
+	lines := strings.Split(string(reply), "\r\n")
+	if len(lines) < 5 {
+		return defaultPingPeriod
 	}
+	period, err := strconv.Atoi(lines[4])
+	if err != nil || period <= 0 {
+		return defaultPingPeriod
+	}
+	return time.Duration(period) * time.Second
 }
 
 func (p *Psync) cleanup() {
 	p.cancel()
-	p.src.close()
-	p.dest.close()
+	err := p.src.close()
+	if err != nil {
+		fmt.Println(err)
+	}
+	p.sink.disconnect()
+	if p.archive != nil {
+		err = p.archive.close()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	err = p.saveCheckpoint()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// position is the replication id and the offset of everything read from the
+// source, which is where a partial resync continues from.
+func (p *Psync) position() (string, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.replID, p.offset
+}
+
+func (p *Psync) setPosition(replID string, offset int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.replID, p.offset = replID, offset
+}
+
+func (p *Psync) advance(n int) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offset += int64(n)
+	return p.offset
+}
+
+// applied is the replication id and the offset of everything acknowledged by
+// the destination, which is what gets reported and checkpointed.
+func (p *Psync) applied() (string, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.replID, p.sink.offset()
+}
+
+// resume picks up the replication position from the checkpoint, if any.
+func (p *Psync) resume() error {
+	if p.checkpoint == "" {
+		return nil
+	}
+	c, err := readCheckpoint(p.checkpoint)
+	if err != nil || c == nil {
+		return err
+	}
+	fmt.Printf("resuming from checkpoint %s at offset %d written %s\n", c.ReplID, c.Offset, c.Time)
+	p.setPosition(c.ReplID, c.Offset)
+	p.sink.reset(c.Offset)
+	return nil
+}
+
+func (p *Psync) saveCheckpoint() error {
+	if p.checkpoint == "" {
+		return nil
+	}
+	replID, offset := p.applied()
+	return writeCheckpoint(p.checkpoint, &checkpoint{
+		ReplID: replID,
+		Offset: offset,
+		Time:   time.Now(),
+	})
+}
+
+func (p *Psync) checkpointLoop() {
+	t := time.NewTicker(p.checkpointInterval)
+	defer t.Stop()
+	_, last := p.applied()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-t.C:
+			_, offset := p.applied()
+			if offset == last {
+				continue
+			}
+			err := p.saveCheckpoint()
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			last = offset
+		}
+	}
 }
 
 func (p *Psync) sync() error {
-	p.dest.writer.flushall()
 	p.src.writer.capa()
-	_, err := p.src.reader.readLine()
+	_, err := p.src.reader.readStatus()
 	if err != nil {
-		return fmt.Errorf("failed to send capa :%w", err)
+		return p.replError("failed to send capa", err)
 	}
-	p.src.writer.sync()
-	r, n, err := p.src.reader.getRDB()
+	lastID, lastOffset := p.position()
+	p.src.writer.psync(lastID, lastOffset)
+	full, replID, offset, err := p.src.reader.readPsync()
 	if err != nil {
-		return fmt.Errorf("failed to sync RDB data :%w", err)
+		return p.replError("failed to psync", err)
 	}
-	err = loadRDB(p.ctx, r, p.dest.addr, n)
-	if err != nil {
-		return fmt.Errorf("failed to load rdb: %w", err)
+	var in commandReader = p.src.reader
+	if full {
+		if lastID != "?" {
+			fmt.Printf("source has no backlog for %s at offset %d, falling back to full resync\n", lastID, lastOffset)
+		}
+		fmt.Printf("full resync from %s at offset %d\n", replID, offset)
+		// the destination is about to be flushed, so a stale checkpoint
+		// must not survive a crash during the load
+		p.setPosition("?", -1)
+		p.sink.reset(-1)
+		err = p.saveCheckpoint()
+		if err != nil {
+			return err
+		}
+		sp, err := p.fullSync(offset)
+		if err != nil {
+			return err
+		}
+		if sp != nil {
+			in = sp
+			defer sp.close()
+		}
+		p.setPosition(replID, offset)
+		p.sink.reset(offset)
+		err = p.saveCheckpoint()
+		if err != nil {
+			return err
+		}
+	} else {
+		if replID != "" {
+			_, offset = p.position()
+			p.setPosition(replID, offset)
+		}
+		replID, offset = p.position()
+		fmt.Printf("continuing replication from %s at offset %d\n", replID, offset)
 	}
-	err = p.repl()
+	p.retry.reset()
+	err = p.repl(in)
 	if err != nil {
 		return fmt.Errorf("failed to replicate buffer: %w", err)
 	}
 	return nil
 }
 
-func (p *Psync) repl() error {
+func (p *Psync) replError(msg string, err error) error {
+	if isNoPerm(err) {
+		return fmt.Errorf("%s: user %q lacks permission to replicate from %s, it needs +psync and +replconf: %w", msg, p.src.user, p.src, err)
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// fullSync flushes the destination and loads the rdb of the source into it.
+// With a spool directory the rdb is downloaded first and the stream that
+// follows it is spooled during the load, the returned spool replays it. With
+// an rdb file the payload is also saved there once its checksum checks out.
+// offset is where the stream after the rdb starts.
+func (p *Psync) fullSync(offset int64) (*spool, error) {
+	// nothing still in flight may land after the flush
+	err := p.sink.drain()
+	if err != nil {
+		return nil, err
+	}
+	p.sink.send("FLUSHALL")
+	// FLUSHALL keeps function libraries, the rdb brings the current ones
+	p.sink.send("FUNCTION", "FLUSH")
+	err = p.sink.drain()
+	if err != nil {
+		return nil, err
+	}
+	r, n, mark, err := p.src.reader.getRDB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync RDB data :%w", err)
+	}
+	if p.spoolDir == "" && p.rdbFile == "" {
+		err = loadRDB(p.ctx, r, p.dest, n, mark, p.load)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load rdb: %w", err)
+		}
+		return nil, nil
+	}
+
+	payload := payloadReader(r, n, mark)
+	var snap *snapshot
+	if p.rdbFile != "" {
+		snap, err = createSnapshot(p.rdbFile)
+		if err != nil {
+			return nil, err
+		}
+		defer snap.abort()
+		payload = io.TeeReader(payload, snap)
+	}
+	if p.spoolDir == "" {
+		err = loadRDB(p.ctx, bufio.NewReader(payload), p.dest, n, nil, p.load)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load rdb: %w", err)
+		}
+		// consume the mark of a diskless payload
+		_, err = io.Copy(ioutil.Discard, payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rdb: %w", err)
+		}
+		return nil, snap.commit()
+	}
+
+	f, err := downloadRDB(p.spoolDir, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if snap != nil {
+		err = snap.commit()
+		if err != nil {
+			return nil, err
+		}
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat rdb file: %w", err)
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+	sp, err := newSpool(p.spoolDir, p.spoolLimit, p.src.reader, cancel)
+	if err != nil {
+		return nil, err
+	}
+	// a diskless source holds the stream back until the rdb is
+	// acknowledged, so acknowledge it right away and during the load
+	ack := func() {
+		err := p.src.writer.ack(offset)
+		if err != nil {
+			fmt.Println("failed to send ack:", err)
+		}
+	}
+	ack()
+	done := make(chan struct{})
+	defer close(done)
+	go p.every(done, ack)
+	err = loadRDB(ctx, bufio.NewReader(f), p.dest, int(info.Size()), nil, p.load)
+	if err != nil {
+		sp.close()
+		if serr := sp.error(); serr != nil {
+			err = serr
+		}
+		return nil, fmt.Errorf("failed to load rdb: %w", err)
+	}
+	return sp, nil
+}
+
+const ackInterval = time.Second
+
+func (p *Psync) repl(in commandReader) error {
 	fmt.Println("replicating commands...")
+	done := make(chan struct{})
+	defer close(done)
+	go p.every(done, p.ack)
+	if p.archive != nil {
+		go p.every(done, p.flushArchive)
+	}
 	for {
 		select {
 		case <-p.ctx.Done():
 			fmt.Println("shutting down repl")
 			return nil
 		default:
-			b, err := p.src.reader.readCommand()
+			cmd, err := in.readCommand()
 			if err != nil {
 				if p.ctx.Err() != nil {
 					return nil
 				}
 				return fmt.Errorf("failed to read command :%w", err)
 			}
-			fmt.Printf("%s", b)
-			p.dest.writer.raw(b)
+			// everything is archived, so offsets can be derived from the
+			// position in a segment
+			if p.archive != nil {
+				replID, offset := p.position()
+				err = p.archive.write(replID, offset, cmd)
+				if err != nil {
+					return err
+				}
+			}
+			// GETACK is answered here instead of being forwarded
+			if cmd.is("REPLCONF", "GETACK") {
+				p.ack()
+				p.sink.advance(p.advance(cmd.len()))
+				continue
+			}
+			end := p.advance(cmd.len())
+			if len(cmd.args) == 0 {
+				p.sink.advance(end)
+				continue
+			}
+			fmt.Println(cmd)
+			err = p.sink.write(cmd, end)
+			if err != nil {
+				return err
+			}
 		}
 	}
 }
 
-func (p *Psync) log(r *redis) {
+// every calls fn every ackInterval until done is closed, it keeps the source
+// from timing out psink the same way a replica does.
+func (p *Psync) every(done chan struct{}, fn func()) {
+	t := time.NewTicker(ackInterval)
+	defer t.Stop()
 	for {
 		select {
 		case <-p.ctx.Done():
-			fmt.Println("shutting down log for redis:", r)
 			return
-		default:
-			str, err := r.reader.readLine()
-			if err != nil {
-				if p.ctx.Err() != nil {
-					return
-				}
-				panic(fmt.Errorf("failed to read line :%w", err))
-			}
-			fmt.Printf("RESP: %s", str)
+		case <-done:
+			return
+		case <-t.C:
+			fn()
 		}
 	}
 }
+
+func (p *Psync) flushArchive() {
+	err := p.archive.flush()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (p *Psync) ack() {
+	_, offset := p.applied()
+	err := p.src.writer.ack(offset)
+	if err != nil {
+		fmt.Println("failed to send ack:", err)
+	}
+}
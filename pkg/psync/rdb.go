@@ -32,16 +32,30 @@ const (
 	TypeHashZipList
 	TypeListQuickList
 	TypeStreamListPacks
+	TypeHashListpack
+	TypeZsetListpack
+	TypeListQuickList2
+	TypeStreamListPacks2
+	TypeSetListpack
+	TypeStreamListPacks3
+	TypeHashMetadataPreGA
+	TypeHashListpackExPreGA
+	TypeHashMetadata
+	TypeHashListpackEx
 
 	// Redis RDB protocol
-	FlagOpcodeIdle         = 248
-	FlagOpcodeFreq         = 249
-	FlagOpcodeAux          = 250
-	FlagOpcodeResizeDB     = 251
-	FlagOpcodeExpireTimeMs = 252
-	FlagOpcodeExpireTime   = 253
-	FlagOpcodeSelectDB     = 254
-	FlagOpcodeEOF          = 255
+	FlagOpcodeSlotInfo      = 244
+	FlagOpcodeFunction2     = 245
+	FlagOpcodeFunctionPreGA = 246
+	FlagOpcodeModuleAux     = 247
+	FlagOpcodeIdle          = 248
+	FlagOpcodeFreq          = 249
+	FlagOpcodeAux           = 250
+	FlagOpcodeResizeDB      = 251
+	FlagOpcodeExpireTimeMs  = 252
+	FlagOpcodeExpireTime    = 253
+	FlagOpcodeSelectDB      = 254
+	FlagOpcodeEOF           = 255
 
 	// Redis length type
 	Type6Bit   = 0
@@ -77,26 +91,80 @@ const (
 	EncodeLZF
 
 	VersionMin = 1
-	VersionMax = 9
+	VersionMax = 12
+
+	// Redis module value opcodes
+	ModuleOpcodeEOF    = 0
+	ModuleOpcodeSInt   = 1
+	ModuleOpcodeUInt   = 2
+	ModuleOpcodeFloat  = 3
+	ModuleOpcodeDouble = 4
+	ModuleOpcodeString = 5
+
+	// Redis quicklist node containers
+	QuickListNodePlain  = 1
+	QuickListNodePacked = 2
 )
 
 var (
-	buff   = make([]byte, 8)
 	PosInf = math.Inf(1)
 	NegInf = math.Inf(-1)
 	Nan    = math.NaN()
 )
 
+// LoadOptions control how rdb payloads are loaded into the destination.
+type LoadOptions struct {
+	// SkipModules skips module values the destination can't restore, with
+	// a report per key, instead of failing the load
+	SkipModules bool
+	// WarnChecksum only reports a checksum mismatch instead of failing
+	// the load
+	WarnChecksum bool
+	// ChunkSize is how many elements of a collection are written per
+	// command, 1000 if zero
+	ChunkSize int
+	// ChunkBytes is the size of the pieces larger strings are written in,
+	// 1MB if zero
+	ChunkBytes int
+}
+
 type rdb struct {
-	ctx  context.Context
-	buf  *bufio.Reader
-	conn redigo.Conn
-	i, n int
+	ctx     context.Context
+	buf     *bufio.Reader
+	conn    redigo.Conn
+	opts    LoadOptions
+	version int
+	i, n    int
+	mark    []byte
+	skipped int
+	// crc is the checksum of everything read so far
+	crc uint64
+	// idle and freq are the lru idle time in seconds and the lfu access
+	// frequency of the next key, -1 when the rdb has none
+	idle, freq int64
+	// capture collects the raw bytes read while it is not nil
+	capture []byte
+	// pending holds bytes of the payload that were read ahead, they are read
+	// again before buf
+	pending []byte
+	// noAccess is set once the destination can't restore the payloads of
+	// the rdb, untracked counts keys too large to keep their access time of
+	noAccess  bool
+	untracked int
+	// buff holds fixed size fields while they are decoded
+	buff [8]byte
 }
 
-func loadRDB(ctx context.Context, buf *bufio.Reader, destAddr string, size int) error {
-	fmt.Printf("loading %d bytes of rdb to %s\n", size, destAddr)
-	c, err := redigo.DialURL(fmt.Sprintf("redis://%s", destAddr))
+// loadRDB loads size bytes of rdb payload from buf into the destination. A
+// negative size means the payload is terminated by mark instead, or just by
+// its EOF opcode without one.
+func loadRDB(ctx context.Context, buf *bufio.Reader, dest *redis, size int, mark []byte, opts LoadOptions) error {
+	if size < 0 {
+		fmt.Printf("loading rdb of unknown size to %s\n", dest)
+	} else {
+		fmt.Printf("loading %d bytes of rdb to %s\n", size, dest)
+	}
+	c, err := dest.redigo(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to connect to dest: %w", err)
 	}
@@ -105,7 +173,11 @@ func loadRDB(ctx context.Context, buf *bufio.Reader, destAddr string, size int)
 		ctx:  ctx,
 		buf:  buf,
 		conn: c,
+		opts: opts,
 		n:    size,
+		mark: mark,
+		idle: -1,
+		freq: -1,
 	}
 
 	res, err := r.checkHeader()
@@ -123,17 +195,17 @@ func loadRDB(ctx context.Context, buf *bufio.Reader, destAddr string, size int)
 // 9 bytes length include: 5 bytes "REDIS" and 4 bytes version in rdb.file
 func (r *rdb) checkHeader() (bool, error) {
 	header := make([]byte, 9)
-	n, err := io.ReadFull(r.buf, header)
+	err := r.readFull(header)
 	if err != nil {
 		return false, fmt.Errorf("failed to read RDB header: %w", err)
 	}
-	r.i += n
 
 	// Check "REDIS" string and version.
 	rdbVersion, err := strconv.Atoi(string(header[5:]))
 	if !bytes.Equal(header[0:5], []byte("REDIS")) || err != nil || (rdbVersion < VersionMin || rdbVersion > VersionMax) {
 		return false, fmt.Errorf("invalid header: %w", err)
 	}
+	r.version = rdbVersion
 	return true, nil
 }
 
@@ -142,22 +214,54 @@ func (r *rdb) loadData() error {
 	var hasSelectDb bool
 	var t byte
 	var err error
-	for r.i < r.n {
+	for r.n < 0 || r.i < r.n {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
 		t, err = r.loadByte()
 		if err != nil {
 			return err
 		}
-		if t == FlagOpcodeIdle {
-			_, _, err := r.loadLen()
+		if t == FlagOpcodeSlotInfo {
+			// slot id, keys and expires in the slot, only sizing hints
+			for i := 0; i < 3; i++ {
+				_, _, err := r.loadLen()
+				if err != nil {
+					return fmt.Errorf("parse SlotInfo failed: %w", err)
+				}
+			}
+			continue
+		} else if t == FlagOpcodeFunction2 {
+			code, err := r.loadString()
+			if err != nil {
+				return fmt.Errorf("parse Function failed: %w", err)
+			}
+			err = r.loadFunction(code)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if t == FlagOpcodeFunctionPreGA {
+			return fmt.Errorf("functions saved by a redis 7.0 release candidate are not supported")
+		} else if t == FlagOpcodeModuleAux {
+			err := r.skipModuleAux()
+			if err != nil {
+				return fmt.Errorf("parse ModuleAux failed: %w", err)
+			}
+			continue
+		} else if t == FlagOpcodeIdle {
+			idle, _, err := r.loadLen()
 			if err != nil {
 				return err
 			}
+			r.idle = int64(idle)
 			continue
 		} else if t == FlagOpcodeFreq {
-			_, err := r.loadByte()
+			freq, err := r.loadByte()
 			if err != nil {
 				return err
 			}
+			r.freq = int64(freq)
 			continue
 		} else if t == FlagOpcodeAux {
 			key, err := r.loadString()
@@ -211,15 +315,17 @@ func (r *rdb) loadData() error {
 			hasSelectDb = false
 			continue
 		} else if t == FlagOpcodeEOF {
-			n, err := io.ReadFull(r.buf, buff)
+			if r.skipped > 0 {
+				fmt.Printf("skipped %d module values\n", r.skipped)
+			}
+			if r.untracked > 0 {
+				fmt.Printf("kept no access time of %d keys larger than %d bytes\n", r.untracked, r.chunkBytes())
+			}
+			err := r.checkChecksum()
 			if err != nil {
-				return fmt.Errorf("failed to read checksum: %w", err)
+				return err
 			}
-			r.i += n
-			fmt.Printf("rdb checksum: %x\n", buff)
-			// TODO rdb checksum
-			err = nil
-			break
+			return r.checkMark()
 		}
 		key, err := r.loadString()
 		if err != nil {
@@ -229,21 +335,71 @@ func (r *rdb) loadData() error {
 			return err
 		}
 		expire = -1
+		r.idle, r.freq = -1, -1
 	}
 
 	return err
 }
 
+// checkChecksum reads the crc64 that ends rdbs since version 5 and compares
+// it to the one computed while loading. Redis writes zero when it runs with
+// rdbchecksum no.
+func (r *rdb) checkChecksum() error {
+	if r.version < 5 {
+		return nil
+	}
+	crc := r.crc
+	err := r.readFull(r.buff[:])
+	if err != nil {
+		return fmt.Errorf("failed to read checksum: %w", err)
+	}
+	expected := binary.LittleEndian.Uint64(r.buff[:])
+	if expected == 0 {
+		fmt.Println("rdb has no checksum, the source runs with rdbchecksum no")
+		return nil
+	}
+	if expected == crc {
+		fmt.Printf("rdb checksum %016x verified\n", crc)
+		return nil
+	}
+	if r.opts.WarnChecksum {
+		fmt.Printf("rdb checksum mismatch: expected %016x, computed %016x, the loaded data may be corrupt\n", expected, crc)
+		return nil
+	}
+	return fmt.Errorf("rdb checksum mismatch: expected %016x, computed %016x", expected, crc)
+}
+
+// checkMark consumes the end-of-payload mark of a diskless transfer.
+func (r *rdb) checkMark() error {
+	if r.mark == nil {
+		return nil
+	}
+	mark := make([]byte, len(r.mark))
+	err := r.readFull(mark)
+	if err != nil {
+		return fmt.Errorf("failed to read rdb eof mark: %w", err)
+	}
+	if !bytes.Equal(mark, r.mark) {
+		return fmt.Errorf("rdb eof mark mismatch: got %q, want %q", mark, r.mark)
+	}
+	return nil
+}
+
 func (r *rdb) loadValue(key []byte, t byte, expire int64) error {
 	fmt.Printf("loading key %s, %d\n", key, t)
-	if t == TypeString {
-		val, err := r.loadString()
-		if err != nil {
+	if t == TypeModule || t == TypeModule2 {
+		return r.loadModule(key, t, expire)
+	}
+	// the lru idle time and lfu frequency can only be set with RESTORE
+	if (r.idle >= 0 || r.freq >= 0) && !r.noAccess {
+		restored, err := r.restoreAccess(key, t, expire)
+		if restored || err != nil {
 			return err
 		}
-		res, err := redigo.String(r.conn.Do("SET", key, val))
-		if err != nil || res != "OK" {
-			return fmt.Errorf("failed to SET val %s, %s: %w", key, val, err)
+	}
+	if t == TypeString {
+		if err := r.loadStringValue(key); err != nil {
+			return err
 		}
 	} else if t == TypeList {
 		if err := r.loadList(key); err != nil {
@@ -285,10 +441,34 @@ func (r *rdb) loadValue(key []byte, t byte, expire int64) error {
 		if err := r.loadHashMapZiplist(key); err != nil {
 			return err
 		}
-	} else if t == TypeStreamListPacks {
-		return fmt.Errorf("streams are not supported")
-	} else if t == TypeModule || t == TypeModule2 {
-		return fmt.Errorf("modules are not supported")
+	} else if t == TypeStreamListPacks || t == TypeStreamListPacks2 || t == TypeStreamListPacks3 {
+		if err := r.loadStream(key, t); err != nil {
+			return err
+		}
+	} else if t == TypeHashListpack {
+		if err := r.loadHashMapListpack(key); err != nil {
+			return err
+		}
+	} else if t == TypeZsetListpack {
+		if err := r.loadListpackSortSet(key); err != nil {
+			return err
+		}
+	} else if t == TypeListQuickList2 {
+		if err := r.loadListWithQuickList2(key); err != nil {
+			return err
+		}
+	} else if t == TypeSetListpack {
+		if err := r.loadSetListpack(key); err != nil {
+			return err
+		}
+	} else if t == TypeHashMetadata || t == TypeHashMetadataPreGA {
+		if err := r.loadHashMapWithMetadata(key, t); err != nil {
+			return err
+		}
+	} else if t == TypeHashListpackEx || t == TypeHashListpackExPreGA {
+		if err := r.loadHashMapListpackEx(key, t); err != nil {
+			return err
+		}
 	} else {
 		return fmt.Errorf("unhandled redis type: %d", t)
 	}
@@ -303,17 +483,228 @@ func (r *rdb) loadValue(key []byte, t byte, expire int64) error {
 	return nil
 }
 
+// restoreAccess reads ahead the value of key, of type t, and recreates it
+// from its raw bytes with RESTORE, along with its lru idle time or lfu
+// frequency and its expire time, since expiring it afterwards would count as
+// an access. It reports false when the value is larger than ChunkBytes or the
+// destination can't read the payload, e.g. because it is older than the rdb,
+// the value is then loaded with commands from the bytes read ahead.
+func (r *rdb) restoreAccess(key []byte, t byte, expire int64) (bool, error) {
+	r.capture = []byte{t}
+	err := r.skipValue(t)
+	payload := r.capture
+	r.capture = nil
+	r.pending = payload[1:]
+	if err == errCaptureFull {
+		r.untracked++
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = r.restore(key, payload, expire)
+	if err != nil {
+		fmt.Printf("destination can't restore the rdb payload of %s, keeping no access times: %v\n", key, err)
+		r.noAccess = true
+		return false, nil
+	}
+	r.pending = nil
+	return true, nil
+}
+
+// errCaptureFull stops reading ahead a value larger than ChunkBytes.
+var errCaptureFull = errors.New("value is too large to capture")
+
+// full reports errCaptureFull once more than ChunkBytes have been captured.
+func (r *rdb) full() error {
+	if len(r.capture) > r.chunkBytes() {
+		return errCaptureFull
+	}
+	return nil
+}
+
+// skipValue reads a value of type t without writing it, so that its raw
+// bytes are captured. It stops early with errCaptureFull.
+func (r *rdb) skipValue(t byte) error {
+	switch t {
+	case TypeString:
+		length, encoded, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		if !encoded && length > uint64(r.chunkBytes()) {
+			return errCaptureFull
+		}
+		_, err = r.loadStringBody(length, encoded)
+		return err
+	case TypeList, TypeSet, TypeListQuickList, TypeHash:
+		length, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		if t == TypeHash {
+			length *= 2
+		}
+		for i := uint64(0); i < length; i++ {
+			_, err = r.loadString()
+			if err == nil {
+				err = r.full()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case TypeZset, TypeZset2:
+		length, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < length; i++ {
+			_, err = r.loadString()
+			if err == nil && t == TypeZset2 {
+				_, err = r.loadBinaryFloat()
+			} else if err == nil {
+				_, err = r.loadFloat()
+			}
+			if err == nil {
+				err = r.full()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case TypeHashZipMap, TypeListZipList, TypeSetIntSet, TypeZsetZipList, TypeHashZipList,
+		TypeHashListpack, TypeZsetListpack, TypeSetListpack:
+		_, err := r.loadString()
+		if err != nil {
+			return err
+		}
+		return r.full()
+	case TypeListQuickList2:
+		length, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < length; i++ {
+			_, _, err = r.loadLen()
+			if err == nil {
+				_, err = r.loadString()
+			}
+			if err == nil {
+				err = r.full()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case TypeHashMetadata, TypeHashMetadataPreGA:
+		if t == TypeHashMetadata {
+			_, err := r.loadUint64()
+			if err != nil {
+				return err
+			}
+		}
+		length, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < length; i++ {
+			if t == TypeHashMetadataPreGA {
+				_, err = r.loadUint64()
+			} else {
+				_, _, err = r.loadLen()
+			}
+			if err == nil {
+				_, err = r.loadString()
+			}
+			if err == nil {
+				_, err = r.loadString()
+			}
+			if err == nil {
+				err = r.full()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case TypeHashListpackEx, TypeHashListpackExPreGA:
+		if t == TypeHashListpackEx {
+			_, err := r.loadUint64()
+			if err != nil {
+				return err
+			}
+		}
+		_, err := r.loadString()
+		if err != nil {
+			return err
+		}
+		return r.full()
+	case TypeStreamListPacks, TypeStreamListPacks2, TypeStreamListPacks3:
+		return r.skipStream(t)
+	}
+	return fmt.Errorf("unhandled redis type: %d", t)
+}
+
+// restore recreates key from a serialized value with RESTORE, along with its
+// expire time and the access time of the rdb.
+func (r *rdb) restore(key, value []byte, expire int64) error {
+	args := redigo.Args{}.Add(key)
+	if expire > 0 {
+		args = args.Add(expire, dumpPayload(value, r.version), "REPLACE", "ABSTTL")
+	} else {
+		args = args.Add(0, dumpPayload(value, r.version), "REPLACE")
+	}
+	if r.idle >= 0 {
+		args = args.Add("IDLETIME", r.idle)
+	} else if r.freq >= 0 {
+		args = args.Add("FREQ", r.freq)
+	}
+	_, err := r.conn.Do("RESTORE", args...)
+	return err
+}
+
+// readFull reads exactly len(b) bytes, every read of the payload goes
+// through it or loadByte. Pending bytes were already counted when they were
+// read ahead.
+func (r *rdb) readFull(b []byte) error {
+	p := copy(b, r.pending)
+	r.pending = r.pending[p:]
+	n, err := io.ReadFull(r.buf, b[p:])
+	r.i += n
+	r.crc = crc64Update(r.crc, b[p:p+n])
+	r.record(b[:p+n]...)
+	return err
+}
+
 func (r *rdb) loadByte() (buf byte, err error) {
+	if len(r.pending) > 0 {
+		buf, r.pending = r.pending[0], r.pending[1:]
+		r.record(buf)
+		return buf, nil
+	}
 	buf, err = r.buf.ReadByte()
 	if err != nil {
 		return
 	}
 	r.i++
+	r.crc = crc64UpdateByte(r.crc, buf)
+	r.record(buf)
 	return
 }
 
+// record appends b to the capture.
+func (r *rdb) record(b ...byte) {
+	if r.capture == nil {
+		return
+	}
+	r.capture = append(r.capture, b...)
+}
+
 func (r *rdb) loadLen() (length uint64, isEncode bool, err error) {
-	var n int
 	buf, err := r.loadByte()
 	if err != nil {
 		return
@@ -333,19 +724,17 @@ func (r *rdb) loadLen() (length uint64, isEncode bool, err error) {
 		}
 		length = (uint64(buf)&0x3f)<<8 | uint64(nb)
 	} else if buf == Type32Bit {
-		n, err = io.ReadFull(r.buf, buff[0:4])
+		err = r.readFull(r.buff[0:4])
 		if err != nil {
 			return
 		}
-		r.i += n
-		length = uint64(binary.BigEndian.Uint32(buff))
+		length = uint64(binary.BigEndian.Uint32(r.buff[:]))
 	} else if buf == Type64Bit {
-		n, err = io.ReadFull(r.buf, buff)
+		err = r.readFull(r.buff[:])
 		if err != nil {
 			return
 		}
-		r.i += n
-		length = binary.BigEndian.Uint64(buff)
+		length = binary.BigEndian.Uint64(r.buff[:])
 	} else {
 		err = errors.New(fmt.Sprintf("unknown length encoding %d in loadLen()", typeLen))
 	}
@@ -357,7 +746,11 @@ func (r *rdb) loadString() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return r.loadStringBody(length, needEncode)
+}
 
+// loadStringBody reads a string whose length or encoding was already read.
+func (r *rdb) loadStringBody(length uint64, needEncode bool) ([]byte, error) {
 	if needEncode {
 		switch length {
 		case EncodeInt8:
@@ -378,41 +771,46 @@ func (r *rdb) loadString() ([]byte, error) {
 	}
 
 	res := make([]byte, length)
-	n, err := io.ReadFull(r.buf, res)
-	r.i += n
+	err := r.readFull(res)
 	return res, err
 }
 
 func (r *rdb) loadUint16() (res uint16, err error) {
-	_, err = io.ReadFull(r.buf, buff[:2])
+	err = r.readFull(r.buff[:2])
 	if err != nil {
 		return
 	}
-	r.i += 2
-	res = binary.LittleEndian.Uint16(buff[:2])
+	res = binary.LittleEndian.Uint16(r.buff[:2])
 	return
 }
 
 func (r *rdb) loadUint32() (res uint32, err error) {
-	_, err = io.ReadFull(r.buf, buff[:4])
+	err = r.readFull(r.buff[:4])
 	if err != nil {
 		return
 	}
-	r.i += 4
-	res = binary.LittleEndian.Uint32(buff[:4])
+	res = binary.LittleEndian.Uint32(r.buff[:4])
 	return
 }
 
 func (r *rdb) loadUint64() (res uint64, err error) {
-	_, err = io.ReadFull(r.buf, buff)
+	err = r.readFull(r.buff[:])
 	if err != nil {
 		return
 	}
-	r.i += 8
-	res = binary.LittleEndian.Uint64(buff)
+	res = binary.LittleEndian.Uint64(r.buff[:])
 	return
 }
 
+func (r *rdb) loadRaw(n int) ([]byte, error) {
+	res := make([]byte, n)
+	err := r.readFull(res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 func (r *rdb) loadFloat() (float64, error) {
 	b, err := r.loadByte()
 	if err != nil {
@@ -427,23 +825,21 @@ func (r *rdb) loadFloat() (float64, error) {
 	}
 
 	floatBytes := make([]byte, b)
-	n, err := io.ReadFull(r.buf, floatBytes)
+	err = r.readFull(floatBytes)
 	if err != nil {
 		return 0, err
 	}
-	r.i += n
 	float, err := strconv.ParseFloat(string(floatBytes), 64)
 	return float, err
 }
 
 // 8 bytes float64, follow IEEE754 float64 stddef (standard definitions)
 func (r *rdb) loadBinaryFloat() (float64, error) {
-	n, err := io.ReadFull(r.buf, buff)
+	err := r.readFull(r.buff[:])
 	if err != nil {
 		return 0, err
 	}
-	r.i += n
-	bits := binary.LittleEndian.Uint64(buff)
+	bits := binary.LittleEndian.Uint64(r.buff[:])
 	return math.Float64frombits(bits), nil
 }
 
@@ -457,13 +853,11 @@ func (r *rdb) loadLZF() (res []byte, err error) {
 		return
 	}
 	val := make([]byte, ilength)
-	n, err := io.ReadFull(r.buf, val)
+	err = r.readFull(val)
 	if err != nil {
 		return
 	}
-	r.i += n
-	res = lzfDecompress(val, int(ilength), int(ulength))
-	return
+	return lzfDecompress(val, int(ilength), int(ulength))
 }
 
 func (r *rdb) selectDB(index uint64) error {
@@ -484,20 +878,35 @@ func (r *rdb) loadScript(script []byte) error {
 	return nil
 }
 
+// loadFunction installs a function library, replacing any library of the
+// same name.
+func (r *rdb) loadFunction(code []byte) error {
+	name, err := redigo.String(r.conn.Do("FUNCTION", "LOAD", "REPLACE", code))
+	if err != nil {
+		return fmt.Errorf("failed to load function library: %w", err)
+	}
+	fmt.Printf("loaded function library %s\n", name)
+	return nil
+}
+
 func (r *rdb) loadList(key []byte) error {
 	length, _, err := r.loadLen()
 	if err != nil {
 		return err
 	}
-	var ent []interface{}
+	c := r.newChunker("RPUSH", key)
+	defer c.abort()
 	for i := uint64(0); i < length; i++ {
 		val, err := r.loadString()
 		if err != nil {
 			return err
 		}
-		ent = append(ent, val)
+		err = c.add(val)
+		if err != nil {
+			return err
+		}
 	}
-	n, err := redigo.Int(r.conn.Do("RPUSH", redigo.Args{}.Add(key).AddFlat(ent)...))
+	n, err := c.close()
 	if err != nil || int(length) != n {
 		return fmt.Errorf("failed to RPUSH list %s, %d: %w", key, length, err)
 	}
@@ -510,15 +919,23 @@ func (r *rdb) loadListWithQuickList(key []byte) error {
 		return err
 	}
 
+	c := r.newChunker("RPUSH", key)
+	defer c.abort()
+	var count int
 	for i := uint64(0); i < length; i++ {
 		listItems, err := r.loadZipList()
 		if err != nil {
 			return err
 		}
-		n, err := redigo.Int(r.conn.Do("RPUSH", redigo.Args{}.Add(key).AddFlat(listItems)...))
-		if err != nil || len(listItems) != n {
-			return fmt.Errorf("failed to RPUSH quickList %s, %d: %w", key, len(listItems), err)
+		err = c.addEach(listItems)
+		if err != nil {
+			return err
 		}
+		count += len(listItems)
+	}
+	n, err := c.close()
+	if err != nil || count != n {
+		return fmt.Errorf("failed to RPUSH quickList %s, %d: %w", key, count, err)
 	}
 	return nil
 }
@@ -528,7 +945,7 @@ func (r *rdb) loadListWithZipList(key []byte) error {
 	if err != nil {
 		return err
 	}
-	n, err := redigo.Int(r.conn.Do("RPUSH", redigo.Args{}.Add(key).AddFlat(entries)...))
+	n, err := r.addAll("RPUSH", key, entries)
 	if err != nil || len(entries) != n {
 		return fmt.Errorf("failed to RPUSH zipList %s, %d: %w", key, len(entries), err)
 	}
@@ -562,7 +979,8 @@ func (r *rdb) loadHashMap(key []byte) error {
 	if err != nil {
 		return err
 	}
-	var ent []interface{}
+	c := r.newChunker("HSET", key)
+	defer c.abort()
 	for i := uint64(0); i < length; i++ {
 		field, err := r.loadString()
 		if err != nil {
@@ -572,9 +990,12 @@ func (r *rdb) loadHashMap(key []byte) error {
 		if err != nil {
 			return err
 		}
-		ent = append(ent, field, value)
+		err = c.add(field, value)
+		if err != nil {
+			return err
+		}
 	}
-	n, err := redigo.Int(r.conn.Do("HSET", redigo.Args{}.Add(key).AddFlat(ent)...))
+	n, err := c.close()
 	if err != nil || int(length) != n {
 		return fmt.Errorf("failed to HSET %s, %d: %w", key, length, err)
 	}
@@ -601,7 +1022,8 @@ func (r *rdb) loadHashMapWithZipmap(key []byte) error {
 		length /= 2
 	}
 
-	var ent []interface{}
+	c := r.newChunker("HSET", key)
+	defer c.abort()
 	for i := 0; i < length; i++ {
 		field, err := loadZipmapItem(buf, false)
 		if err != nil {
@@ -611,9 +1033,12 @@ func (r *rdb) loadHashMapWithZipmap(key []byte) error {
 		if err != nil {
 			return err
 		}
-		ent = append(ent, field, value)
+		err = c.add(field, value)
+		if err != nil {
+			return err
+		}
 	}
-	n, err := redigo.Int(r.conn.Do("HSET", redigo.Args{}.Add(key).AddFlat(ent)...))
+	n, err := c.close()
 	if err != nil || int(length) != n {
 		return fmt.Errorf("failed to HSET %s, %d: %w", key, length, err)
 	}
@@ -632,7 +1057,8 @@ func (r *rdb) loadHashMapZiplist(key []byte) error {
 	}
 	length /= 2
 
-	var ent []interface{}
+	c := r.newChunker("HSET", key)
+	defer c.abort()
 	for i := int64(0); i < length; i++ {
 		field, err := loadZiplistEntry(buf)
 		if err != nil {
@@ -642,9 +1068,12 @@ func (r *rdb) loadHashMapZiplist(key []byte) error {
 		if err != nil {
 			return err
 		}
-		ent = append(ent, field, value)
+		err = c.add(field, value)
+		if err != nil {
+			return err
+		}
 	}
-	n, err := redigo.Int(r.conn.Do("HSET", redigo.Args{}.Add(key).AddFlat(ent)...))
+	n, err := c.close()
 	if err != nil || int(length) != n {
 		return fmt.Errorf("failed to HSET %s, %d: %w", key, length, err)
 	}
@@ -656,15 +1085,19 @@ func (r *rdb) loadSet(key []byte) error {
 	if err != nil {
 		return err
 	}
-	var ent []interface{}
+	c := r.newChunker("SADD", key)
+	defer c.abort()
 	for i := uint64(0); i < length; i++ {
 		member, err := r.loadString()
 		if err != nil {
 			return err
 		}
-		ent = append(ent, member)
+		err = c.add(member)
+		if err != nil {
+			return err
+		}
 	}
-	n, err := redigo.Int(r.conn.Do("SADD", redigo.Args{}.Add(key).AddFlat(ent)...))
+	n, err := c.close()
 	if err != nil || int(length) != n {
 		return fmt.Errorf("failed to SADD %s, %d: %w", key, length, err)
 	}
@@ -690,7 +1123,8 @@ func (r *rdb) loadIntSet(key []byte) error {
 		return err
 	}
 	cardinality := binary.LittleEndian.Uint32(lenBytes)
-	var ent []interface{}
+	c := r.newChunker("SADD", key)
+	defer c.abort()
 	for i := uint32(0); i < cardinality; i++ {
 		intBytes, err := buf.Slice(int(intSize))
 		if err != nil {
@@ -705,9 +1139,12 @@ func (r *rdb) loadIntSet(key []byte) error {
 		case 8:
 			intString = strconv.FormatInt(int64(int64(binary.LittleEndian.Uint64(intBytes))), 10)
 		}
-		ent = append(ent, intString)
+		err = c.add(intString)
+		if err != nil {
+			return err
+		}
 	}
-	n, err := redigo.Int(r.conn.Do("SADD", redigo.Args{}.Add(key).AddFlat(ent)...))
+	n, err := c.close()
 	if err != nil || int(cardinality) != n {
 		return fmt.Errorf("failed to SADD %s, %d: %w", key, cardinality, err)
 	}
@@ -719,7 +1156,8 @@ func (r *rdb) loadZSet(key []byte, t byte) error {
 	if err != nil {
 		return err
 	}
-	var ent []interface{}
+	c := r.newChunker("ZADD", key)
+	defer c.abort()
 	for i := uint64(0); i < length; i++ {
 		member, err := r.loadString()
 		if err != nil {
@@ -734,9 +1172,12 @@ func (r *rdb) loadZSet(key []byte, t byte) error {
 		if err != nil {
 			return err
 		}
-		ent = append(ent, score, member)
+		err = c.add(score, member)
+		if err != nil {
+			return err
+		}
 	}
-	n, err := redigo.Int(r.conn.Do("ZADD", redigo.Args{}.Add(key).AddFlat(ent)...))
+	n, err := c.close()
 	if err != nil || int(length) != n {
 		return fmt.Errorf("failed to ZADD %s, %d: %w", key, length, err)
 	}
@@ -755,7 +1196,8 @@ func (r *rdb) loadZipListSortSet(key []byte) error {
 	}
 	cardinality /= 2
 
-	var ent []interface{}
+	c := r.newChunker("ZADD", key)
+	defer c.abort()
 	for i := int64(0); i < cardinality; i++ {
 		member, err := loadZiplistEntry(buf)
 		if err != nil {
@@ -769,11 +1211,253 @@ func (r *rdb) loadZipListSortSet(key []byte) error {
 		if err != nil {
 			return err
 		}
-		ent = append(ent, score, member)
+		err = c.add(score, member)
+		if err != nil {
+			return err
+		}
 	}
-	n, err := redigo.Int(r.conn.Do("ZADD", redigo.Args{}.Add(key).AddFlat(ent)...))
+	n, err := c.close()
 	if err != nil || int(cardinality) != n {
 		return fmt.Errorf("failed to ZADD %s, %d: %w", key, cardinality, err)
 	}
 	return nil
 }
+
+func (r *rdb) loadListpack() ([][]byte, error) {
+	b, err := r.loadString()
+	if err != nil {
+		return nil, err
+	}
+	buf := newInput(b)
+	length, err := loadListpackLength(buf)
+	if err != nil {
+		return nil, err
+	}
+	// the header can't count more than 65535 entries, so read up to the end
+	items := make([][]byte, 0, length)
+	for {
+		entry, err := loadListpackEntry(buf)
+		if err == errListpackEnd {
+			if length < 65535 && int64(len(items)) != length {
+				return nil, fmt.Errorf("listpack has %d entries, but its header counts %d", len(items), length)
+			}
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, entry)
+	}
+}
+
+func (r *rdb) loadListWithQuickList2(key []byte) error {
+	length, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+
+	c := r.newChunker("RPUSH", key)
+	defer c.abort()
+	var count int
+	for i := uint64(0); i < length; i++ {
+		container, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		var listItems [][]byte
+		switch container {
+		case QuickListNodePlain:
+			item, err := r.loadString()
+			if err != nil {
+				return err
+			}
+			listItems = [][]byte{item}
+		case QuickListNodePacked:
+			listItems, err = r.loadListpack()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown quicklist node container: %d", container)
+		}
+		err = c.addEach(listItems)
+		if err != nil {
+			return err
+		}
+		count += len(listItems)
+	}
+	n, err := c.close()
+	if err != nil || count != n {
+		return fmt.Errorf("failed to RPUSH quickList %s, %d: %w", key, count, err)
+	}
+	return nil
+}
+
+func (r *rdb) loadHashMapListpack(key []byte) error {
+	ent, err := r.loadListpack()
+	if err != nil {
+		return err
+	}
+	c := r.newChunker("HSET", key)
+	defer c.abort()
+	for i := 0; i+1 < len(ent); i += 2 {
+		err = c.add(ent[i], ent[i+1])
+		if err != nil {
+			return err
+		}
+	}
+	n, err := c.close()
+	if err != nil || len(ent)/2 != n {
+		return fmt.Errorf("failed to HSET %s, %d: %w", key, len(ent)/2, err)
+	}
+	return nil
+}
+
+func (r *rdb) loadSetListpack(key []byte) error {
+	ent, err := r.loadListpack()
+	if err != nil {
+		return err
+	}
+	n, err := r.addAll("SADD", key, ent)
+	if err != nil || len(ent) != n {
+		return fmt.Errorf("failed to SADD %s, %d: %w", key, len(ent), err)
+	}
+	return nil
+}
+
+func (r *rdb) loadListpackSortSet(key []byte) error {
+	items, err := r.loadListpack()
+	if err != nil {
+		return err
+	}
+	c := r.newChunker("ZADD", key)
+	defer c.abort()
+	for i := 0; i+1 < len(items); i += 2 {
+		score, err := strconv.ParseFloat(string(items[i+1]), 64)
+		if err != nil {
+			return err
+		}
+		err = c.add(score, items[i])
+		if err != nil {
+			return err
+		}
+	}
+	n, err := c.close()
+	if err != nil || len(items)/2 != n {
+		return fmt.Errorf("failed to ZADD %s, %d: %w", key, len(items)/2, err)
+	}
+	return nil
+}
+
+// loadHashMapWithMetadata loads a hash whose fields have their own expire
+// time. Since rdb 12 the times are stored relative to the minimum one.
+func (r *rdb) loadHashMapWithMetadata(key []byte, t byte) error {
+	var minExpire uint64
+	var err error
+	if t == TypeHashMetadata {
+		minExpire, err = r.loadUint64()
+		if err != nil {
+			return err
+		}
+	}
+	length, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	c := r.newChunker("HSET", key)
+	defer c.abort()
+	expires := make(map[string]uint64)
+	for i := uint64(0); i < length; i++ {
+		var expire uint64
+		if t == TypeHashMetadataPreGA {
+			expire, err = r.loadUint64()
+		} else {
+			// stored as ttl - minExpire + 1, zero for a field without one
+			expire, _, err = r.loadLen()
+			if expire != 0 {
+				expire += minExpire - 1
+			}
+		}
+		if err != nil {
+			return err
+		}
+		field, err := r.loadString()
+		if err != nil {
+			return err
+		}
+		value, err := r.loadString()
+		if err != nil {
+			return err
+		}
+		err = c.add(field, value)
+		if err != nil {
+			return err
+		}
+		if expire != 0 {
+			expires[string(field)] = expire
+		}
+	}
+	n, err := c.close()
+	if err != nil || int(length) != n {
+		return fmt.Errorf("failed to HSET %s, %d: %w", key, length, err)
+	}
+	return r.expireFields(key, expires)
+}
+
+// loadHashMapListpackEx loads a listpack of field, value and expire time
+// triplets, an expire time of zero means the field doesn't expire.
+func (r *rdb) loadHashMapListpackEx(key []byte, t byte) error {
+	if t == TypeHashListpackEx {
+		// the minimum expire time is only needed for the hash index
+		_, err := r.loadUint64()
+		if err != nil {
+			return err
+		}
+	}
+	items, err := r.loadListpack()
+	if err != nil {
+		return err
+	}
+	c := r.newChunker("HSET", key)
+	defer c.abort()
+	expires := make(map[string]uint64)
+	for i := 0; i+2 < len(items); i += 3 {
+		err = c.add(items[i], items[i+1])
+		if err != nil {
+			return err
+		}
+		expire, err := strconv.ParseUint(string(items[i+2]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid expire time of field %s in %s: %w", items[i], key, err)
+		}
+		if expire != 0 {
+			expires[string(items[i])] = expire
+		}
+	}
+	n, err := c.close()
+	if err != nil || len(items)/3 != n {
+		return fmt.Errorf("failed to HSET %s, %d: %w", key, len(items)/3, err)
+	}
+	return r.expireFields(key, expires)
+}
+
+// expireFields sets the expire times of hash fields in unix milliseconds.
+func (r *rdb) expireFields(key []byte, expires map[string]uint64) error {
+	if len(expires) == 0 {
+		return nil
+	}
+	for field, expire := range expires {
+		err := r.conn.Send("HPEXPIREAT", key, expire, "FIELDS", 1, field)
+		if err != nil {
+			return fmt.Errorf("failed to HPEXPIREAT %s %s: %w", key, field, err)
+		}
+	}
+	replies, err := redigo.Values(r.conn.Do(""))
+	if err == nil {
+		err = pipelineError(replies)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to HPEXPIREAT %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package psync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeConn records the commands of the loader and answers them the way redis
+// would for the loader's purposes.
+type fakeConn struct {
+	cmds    []string
+	pending []interface{}
+	tx      []interface{}
+	inTx    bool
+}
+
+func (c *fakeConn) exec(cmd string, args []interface{}) interface{} {
+	s := []string{cmd}
+	for _, arg := range args {
+		if b, ok := arg.([]byte); ok {
+			arg = string(b)
+		}
+		s = append(s, fmt.Sprint(arg))
+	}
+	c.cmds = append(c.cmds, strings.Join(s, " "))
+	var reply interface{} = "OK"
+	switch cmd {
+	case "MULTI":
+		c.inTx = true
+		return reply
+	case "EXEC":
+		c.inTx = false
+		reply, c.tx = c.tx, nil
+		return reply
+	case "HSET":
+		reply = int64((len(args) - 1) / 2)
+	case "DEL":
+		reply = int64(0)
+	case "HPEXPIREAT":
+		reply = []interface{}{int64(1)}
+	}
+	if c.inTx {
+		c.tx = append(c.tx, reply)
+		return "QUEUED"
+	}
+	return reply
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		replies := c.pending
+		c.pending = nil
+		return replies, nil
+	}
+	c.pending = nil
+	return c.exec(cmd, args), nil
+}
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, c.exec(cmd, args))
+	return nil
+}
+
+func (c *fakeConn) Close() error                  { return nil }
+func (c *fakeConn) Err() error                    { return nil }
+func (c *fakeConn) Flush() error                  { return nil }
+func (c *fakeConn) Receive() (interface{}, error) { return nil, nil }
+
+// rdbString encodes b as a length prefixed rdb string.
+func rdbString(b []byte) []byte {
+	if len(b) < 64 {
+		return append([]byte{byte(len(b))}, b...)
+	}
+	return append([]byte{0x40 | byte(len(b)>>8), byte(len(b))}, b...)
+}
+
+func le64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestLoadHashFieldExpires(t *testing.T) {
+	const minExpire = 1700000000000
+	want := []string{
+		"MULTI",
+		"DEL h",
+		"HSET h f1 v1 f2 v2",
+		"EXEC",
+		"HPEXPIREAT h 1700000000000 FIELDS 1 f1",
+	}
+	tests := []struct {
+		name  string
+		t     byte
+		value []byte
+		want  []string
+	}{
+		{
+			name: "metadata",
+			t:    TypeHashMetadata,
+			// ttls are stored as ttl - minExpire + 1, zero for none
+			value: join(le64(minExpire), []byte{2},
+				[]byte{1}, rdbString([]byte("f1")), rdbString([]byte("v1")),
+				[]byte{0}, rdbString([]byte("f2")), rdbString([]byte("v2"))),
+			want: want,
+		},
+		{
+			name: "metadata later field",
+			t:    TypeHashMetadata,
+			// 5001 as a 14 bit length
+			value: join(le64(minExpire), []byte{2},
+				[]byte{0}, rdbString([]byte("f1")), rdbString([]byte("v1")),
+				[]byte{0x53, 0x89}, rdbString([]byte("f2")), rdbString([]byte("v2"))),
+			want: []string{
+				"MULTI",
+				"DEL h",
+				"HSET h f1 v1 f2 v2",
+				"EXEC",
+				"HPEXPIREAT h 1700000005000 FIELDS 1 f2",
+			},
+		},
+		{
+			name: "metadata pre ga",
+			t:    TypeHashMetadataPreGA,
+			value: join([]byte{2},
+				le64(minExpire), rdbString([]byte("f1")), rdbString([]byte("v1")),
+				le64(0), rdbString([]byte("f2")), rdbString([]byte("v2"))),
+			want: want,
+		},
+		{
+			name: "listpack ex",
+			t:    TypeHashListpackEx,
+			value: join(le64(minExpire), rdbString(listpack(
+				lpString("f1"), lpString("v1"), lpInt(minExpire),
+				lpString("f2"), lpString("v2"), lpInt(0)))),
+			want: want,
+		},
+		{
+			name: "listpack ex pre ga",
+			t:    TypeHashListpackExPreGA,
+			value: rdbString(listpack(
+				lpString("f1"), lpString("v1"), lpInt(minExpire),
+				lpString("f2"), lpString("v2"), lpInt(0))),
+			want: want,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fakeConn{}
+			buf := bufio.NewReader(bytes.NewReader(tt.value))
+			r := &rdb{ctx: context.Background(), buf: buf, conn: c, n: -1, version: 12, idle: -1, freq: -1}
+			err := r.loadValue([]byte("h"), tt.t, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.cmds, tt.want) {
+				t.Errorf("got commands\n%s\nwant\n%s", strings.Join(c.cmds, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if buf.Buffered() != 0 || r.i != len(tt.value) {
+				t.Errorf("read %d of %d bytes", r.i, len(tt.value))
+			}
+		})
+	}
+}
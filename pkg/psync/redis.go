@@ -3,54 +3,175 @@ package psync
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
 )
 
-type redis struct {
-	ctx    context.Context
-	cancel context.CancelFunc
-	addr   string
-	conn   net.Conn
-	reader *reader
-	writer *writer
+// Timeouts bound how long a redis may take to respond. Zero values select
+// the defaults: defaultDialTimeout, no read or write deadline and the keepalive
+// period of net.Dialer. A negative KeepAlive disables keepalives.
+type Timeouts struct {
+	Dial      time.Duration
+	Read      time.Duration
+	Write     time.Duration
+	KeepAlive time.Duration
 }
 
-func newRedis(addr string) *redis {
-	return &redis{
-		addr: addr,
-	}
+const defaultDialTimeout = 5 * time.Second
+
+type redis struct {
+	network  string
+	addr     string
+	user     string
+	password string
+	tls      *tls.Config
+	timeouts Timeouts
+	conn     *timeoutConn
+	reader   *reader
+	writer   *writer
 }
 
 func (r *redis) String() string {
+	if r.network == "unix" {
+		return "unix://" + r.addr
+	}
 	return r.addr
 }
 
+func (r *redis) dial(ctx context.Context) (net.Conn, error) {
+	timeout := r.timeouts.Dial
+	if timeout == 0 {
+		timeout = defaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	d := net.Dialer{KeepAlive: r.timeouts.KeepAlive}
+	conn, err := d.DialContext(ctx, r.network, r.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	if r.tls == nil {
+		return conn, nil
+	}
+	tlsConn, err := handshake(ctx, conn, r.addr, r.tls)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
 func (r *redis) connect(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	var d net.Dialer
-	conn, err := d.DialContext(ctx, "tcp", r.addr)
+	conn, err := r.dial(ctx)
 	if err != nil {
-		cancel()
-		return fmt.Errorf("failed to connect to redis: %w", err)
+		return err
 	}
-	r.ctx = ctx
-	r.cancel = cancel
-	r.conn = conn
+	r.conn = &timeoutConn{Conn: conn, read: r.timeouts.Read, write: r.timeouts.Write}
 	r.reader = newReader(r.conn)
 	r.writer = newWriter(r.conn)
+	if r.password != "" {
+		r.writer.raw(newCommand(r.authArgs()...).raw)
+		_, err = r.reader.readStatus()
+		if err != nil {
+			r.close()
+			return r.authError(err)
+		}
+	}
 	return nil
 }
 
-func (r *redis) close() {
-	r.cancel()
+// redigo opens a separate, authenticated redigo connection.
+func (r *redis) redigo(ctx context.Context) (redigo.Conn, error) {
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := redigo.NewConn(conn, r.timeouts.Read, r.timeouts.Write)
+	if r.password != "" {
+		args := r.authArgs()
+		_, err = c.Do(args[0], redigo.Args{}.AddFlat(args[1:])...)
+		if err != nil {
+			c.Close()
+			return nil, r.authError(err)
+		}
+	}
+	return c, nil
+}
+
+// pipelineError returns the first error among pipelined replies, which Do
+// doesn't report itself.
+func pipelineError(replies []interface{}) error {
+	for _, reply := range replies {
+		if err, ok := reply.(redigo.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// authArgs is AUTH with a password only for the default user, or with an ACL
+// user and password on redis 6 and later.
+func (r *redis) authArgs() []string {
+	if r.user == "" {
+		return []string{"AUTH", r.password}
+	}
+	return []string{"AUTH", r.user, r.password}
+}
+
+func (r *redis) authError(err error) error {
+	if r.user == "" {
+		return fmt.Errorf("failed to authenticate to %s: %w", r, err)
+	}
+	return fmt.Errorf("failed to authenticate to %s as %s: %w", r, r.user, err)
+}
+
+func (r *redis) close() error {
+	if r.conn == nil {
+		return nil
+	}
 	err := r.conn.Close()
+	r.conn = nil
 	if err != nil {
-		panic(fmt.Errorf("failed to close redis connection: %w", err))
+		return fmt.Errorf("failed to close redis connection: %w", err)
 	}
+	return nil
+}
+
+// timeoutConn fails reads that see no data and writes that make no progress
+// for longer than their timeout, so a silently dead peer surfaces as an error
+// instead of a hang.
+type timeoutConn struct {
+	net.Conn
+	read, write time.Duration
+}
+
+func (t *timeoutConn) Read(b []byte) (int, error) {
+	if t.read > 0 {
+		err := t.SetReadDeadline(time.Now().Add(t.read))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return t.Conn.Read(b)
+}
+
+func (t *timeoutConn) Write(b []byte) (int, error) {
+	if t.write > 0 {
+		err := t.SetWriteDeadline(time.Now().Add(t.write))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return t.Conn.Write(b)
 }
 
 type reader struct {
@@ -67,36 +188,98 @@ func (r *reader) readLine() (string, error) {
 	return r.buf.ReadString('\n')
 }
 
-func (r *reader) getRDB() (*bufio.Reader, int, error) {
+// replyError is an error reply sent by redis.
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+// isNoPerm reports whether err is redis refusing a command the ACL user has
+// no permission to run.
+func isNoPerm(err error) bool {
+	var re replyError
+	return errors.As(err, &re) && strings.HasPrefix(string(re), "NOPERM")
+}
+
+// readStatus reads a status reply, error replies are returned as a
+// replyError.
+func (r *reader) readStatus() (string, error) {
+	str, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+	str = strings.TrimRight(str, "\r\n")
+	if strings.HasPrefix(str, "-") {
+		return "", replyError(str[1:])
+	}
+	return str, nil
+}
+
+// eofMarkSize is the length of the random delimiter a diskless source uses in
+// place of the payload size when the replica advertised capa eof.
+const eofMarkSize = 40
+
+// getRDB reads the header of the RDB payload and returns either its size, or
+// -1 and the mark that terminates a payload of unknown size.
+func (r *reader) getRDB() (*bufio.Reader, int, []byte, error) {
 	str, err := r.buf.ReadString('\n')
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to read size of rdb data: %w", err)
+		return nil, 0, nil, fmt.Errorf("failed to read size of rdb data: %w", err)
 	}
 	//ignore the idle \n while rdb file is building
 	for len(str) == 1 {
 		str, err = r.buf.ReadString('\n')
 		if err != nil {
-			return nil, 0, fmt.Errorf("failed to read size of rdb data: %w", err)
+			return nil, 0, nil, fmt.Errorf("failed to read size of rdb data: %w", err)
 		}
 	}
 
+	if strings.HasPrefix(str, "$EOF:") {
+		mark := strings.TrimRight(str[5:], "\r\n")
+		if len(mark) != eofMarkSize {
+			return nil, 0, nil, fmt.Errorf("invalid rdb eof mark: %s", str)
+		}
+		return r.buf, -1, []byte(mark), nil
+	}
+
 	l, err := strconv.Atoi(str[1 : len(str)-2])
 	if str[0] != '$' || err != nil {
-		return nil, 0, fmt.Errorf("failed to read size of rdb data: %w, %s", err, str)
+		return nil, 0, nil, fmt.Errorf("failed to read size of rdb data: %w, %s", err, str)
 	}
 
-	return r.buf, l, nil
+	return r.buf, l, nil, nil
 }
 
-func (r *reader) readCommand() ([]byte, error) {
-	b, err := r.buf.ReadBytes('\n')
+// readPsync parses the reply to PSYNC, reporting whether the source requires a
+// full resync along with the replication id and offset it announced.
+func (r *reader) readPsync() (bool, string, int64, error) {
+	str, err := r.buf.ReadString('\n')
 	if err != nil {
-		return nil, fmt.Errorf("failed to read command: %w", err)
+		return false, "", 0, fmt.Errorf("failed to read psync reply: %w", err)
 	}
-	return b, nil
+	fields := strings.Fields(str)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return false, "", 0, fmt.Errorf("invalid offset in psync reply %q: %w", str, err)
+		}
+		return true, fields[1], offset, nil
+	case len(fields) == 1 && fields[0] == "+CONTINUE":
+		return false, "", 0, nil
+	case len(fields) == 2 && fields[0] == "+CONTINUE":
+		return false, fields[1], 0, nil
+	case strings.HasPrefix(str, "-LOADING") || strings.HasPrefix(str, "-NOMASTERLINK"):
+		return false, "", 0, fmt.Errorf("%w: %s", errBusy, strings.TrimSpace(str))
+	case strings.HasPrefix(str, "-"):
+		return false, "", 0, replyError(strings.TrimSpace(str[1:]))
+	}
+	return false, "", 0, fmt.Errorf("unexpected psync reply: %q", str)
 }
 
 type writer struct {
+	mu  sync.Mutex
 	buf *bufio.Writer
 }
 
@@ -117,17 +300,28 @@ func (w *writer) ping() error {
 }
 
 func (w *writer) capa() error {
-	w.buf.Write(([]byte)("REPLCONF capa psync2\r\n"))
+	w.buf.Write(([]byte)("REPLCONF capa eof capa psync2\r\n"))
 	return w.flush()
 }
 
-func (w *writer) sync() error {
-	w.buf.Write(([]byte)("SYNC\r\n"))
+// psync requests a partial resync continuing after offset, the last byte of
+// the replication stream already processed. An unknown replID ("?") asks the
+// source for a full resync.
+func (w *writer) psync(replID string, offset int64) error {
+	if replID == "?" {
+		w.buf.Write(([]byte)("PSYNC ? -1\r\n"))
+	} else {
+		fmt.Fprintf(w.buf, "PSYNC %s %d\r\n", replID, offset+1)
+	}
 	return w.flush()
 }
 
-func (w *writer) flushall() error {
-	w.buf.Write(([]byte)("FLUSHALL\r\n"))
+// ack may be called concurrently, it is the only thing written to the source
+// once the stream has started.
+func (w *writer) ack(offset int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(w.buf, "REPLCONF ACK %d\r\n", offset)
 	return w.flush()
 }
 
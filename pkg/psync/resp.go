@@ -0,0 +1,173 @@
+package psync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxArgs    = 1024 * 1024
+	maxBulkLen = 512 * 1024 * 1024
+)
+
+// command is a single command decoded from a RESP stream, raw holds the exact
+// bytes it was read from so it can be forwarded untouched.
+type command struct {
+	args [][]byte
+	raw  []byte
+}
+
+// len is the number of bytes the command occupied in the stream.
+func (c *command) len() int {
+	return len(c.raw)
+}
+
+func (c *command) name() string {
+	if len(c.args) == 0 {
+		return ""
+	}
+	return strings.ToUpper(string(c.args[0]))
+}
+
+// is reports whether the command starts with args, ignoring case.
+func (c *command) is(args ...string) bool {
+	if len(c.args) < len(args) {
+		return false
+	}
+	for i, arg := range args {
+		if !strings.EqualFold(string(c.args[i]), arg) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *command) String() string {
+	return string(bytes.Join(c.args, []byte(" ")))
+}
+
+// readCommand decodes the next multi-bulk or inline command.
+func (r *reader) readCommand() (*command, error) {
+	line, err := r.buf.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command: %w", err)
+	}
+	if line[0] != '*' {
+		return parseInline(line), nil
+	}
+	n, err := parseLen(line[1:], maxArgs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multibulk length %q: %w", line, err)
+	}
+
+	raw := line
+	bounds := make([]int, 0, 2*n)
+	for i := 0; i < n; i++ {
+		line, err = r.buf.ReadBytes('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bulk length: %w", err)
+		}
+		if line[0] != '$' {
+			return nil, fmt.Errorf("expected '$', got %q", line)
+		}
+		l, err := parseLen(line[1:], maxBulkLen)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %q: %w", line, err)
+		}
+		raw = append(raw, line...)
+		start := len(raw)
+		raw = append(raw, make([]byte, l+2)...)
+		_, err = io.ReadFull(r.buf, raw[start:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bulk: %w", err)
+		}
+		if !bytes.HasSuffix(raw, []byte("\r\n")) {
+			return nil, fmt.Errorf("bulk of length %d not terminated by CRLF", l)
+		}
+		bounds = append(bounds, start, start+l)
+	}
+
+	c := &command{
+		args: make([][]byte, n),
+		raw:  raw,
+	}
+	for i := range c.args {
+		c.args[i] = raw[bounds[2*i]:bounds[2*i+1]]
+	}
+	return c, nil
+}
+
+func parseInline(line []byte) *command {
+	return &command{
+		args: bytes.Fields(line),
+		raw:  line,
+	}
+}
+
+func parseLen(b []byte, max int) (int, error) {
+	n, err := strconv.Atoi(string(bytes.TrimRight(b, "\r\n")))
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > max {
+		return 0, fmt.Errorf("length %d out of range", n)
+	}
+	return n, nil
+}
+
+// newCommand encodes args as a multi-bulk command.
+func newCommand(args ...string) *command {
+	c := &command{
+		raw: []byte(fmt.Sprintf("*%d\r\n", len(args))),
+	}
+	for _, arg := range args {
+		c.args = append(c.args, []byte(arg))
+		c.raw = append(c.raw, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	return c
+}
+
+// readReply reads one complete reply, including nested arrays, and returns
+// its raw bytes.
+func (r *reader) readReply() ([]byte, error) {
+	line, err := r.buf.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reply: %w", err)
+	}
+	switch line[0] {
+	case '+', '-', ':':
+		return line, nil
+	case '$':
+		l, err := strconv.Atoi(string(bytes.TrimRight(line[1:], "\r\n")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %q: %w", line, err)
+		}
+		if l < 0 {
+			return line, nil
+		}
+		start := len(line)
+		line = append(line, make([]byte, l+2)...)
+		_, err = io.ReadFull(r.buf, line[start:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bulk reply: %w", err)
+		}
+		return line, nil
+	case '*':
+		n, err := strconv.Atoi(string(bytes.TrimRight(line[1:], "\r\n")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length %q: %w", line, err)
+		}
+		for i := 0; i < n; i++ {
+			b, err := r.readReply()
+			if err != nil {
+				return nil, err
+			}
+			line = append(line, b...)
+		}
+		return line, nil
+	}
+	return nil, fmt.Errorf("unexpected reply: %q", line)
+}
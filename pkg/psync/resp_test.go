@@ -0,0 +1,166 @@
+package psync
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		args []string
+		err  bool
+	}{
+		{
+			name: "multibulk",
+			in:   "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n",
+			args: []string{"SET", "key", "value"},
+		},
+		{
+			name: "binary bulk",
+			in:   "*3\r\n$3\r\nSET\r\n$4\r\na\r\nb\r\n$4\r\n\x00\xff\n\r\r\n",
+			args: []string{"SET", "a\r\nb", "\x00\xff\n\r"},
+		},
+		{
+			name: "empty bulk",
+			in:   "*2\r\n$4\r\nECHO\r\n$0\r\n\r\n",
+			args: []string{"ECHO", ""},
+		},
+		{
+			name: "inline",
+			in:   "PING\r\n",
+			args: []string{"PING"},
+		},
+		{
+			name: "inline with arguments",
+			in:   "REPLCONF  GETACK *\n",
+			args: []string{"REPLCONF", "GETACK", "*"},
+		},
+		{
+			name: "bulk not terminated by CRLF",
+			in:   "*1\r\n$3\r\nSETXX",
+			err:  true,
+		},
+		{
+			name: "missing bulk",
+			in:   "*2\r\n$3\r\nSET\r\n:1\r\n",
+			err:  true,
+		},
+		{
+			name: "negative multibulk length",
+			in:   "*-1\r\n",
+			err:  true,
+		},
+		{
+			name: "truncated bulk",
+			in:   "*1\r\n$10\r\nSET\r\n",
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newReader(strings.NewReader(tt.in)).readCommand()
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", c.args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(c.args) != len(tt.args) {
+				t.Fatalf("got %d args %q, want %q", len(c.args), c.args, tt.args)
+			}
+			for i, arg := range tt.args {
+				if string(c.args[i]) != arg {
+					t.Errorf("arg %d is %q, want %q", i, c.args[i], arg)
+				}
+			}
+			if string(c.raw) != tt.in {
+				t.Errorf("raw is %q, want %q", c.raw, tt.in)
+			}
+		})
+	}
+}
+
+func TestReadCommandSequence(t *testing.T) {
+	in := "*1\r\n$4\r\nPING\r\n*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n"
+	r := newReader(strings.NewReader(in))
+	var n int
+	for _, name := range []string{"PING", "SELECT"} {
+		c, err := r.readCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.name() != name {
+			t.Errorf("got %s, want %s", c.name(), name)
+		}
+		n += c.len()
+	}
+	if n != len(in) {
+		t.Errorf("commands took %d bytes, want %d", n, len(in))
+	}
+	_, err := r.readCommand()
+	if err == nil || !strings.Contains(err.Error(), io.EOF.Error()) {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestNewCommand(t *testing.T) {
+	c := newCommand("SET", "a\r\nb", "")
+	got, err := newReader(bytes.NewReader(c.raw)).readCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.raw, c.raw) || len(got.args) != 3 || string(got.args[1]) != "a\r\nb" || len(got.args[2]) != 0 {
+		t.Errorf("round trip of %q gave %q", c.raw, got.args)
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		err  bool
+	}{
+		{name: "status", in: "+OK\r\n"},
+		{name: "error", in: "-ERR unknown command\r\n"},
+		{name: "integer", in: ":42\r\n"},
+		{name: "binary bulk", in: "$5\r\na\r\n\x00b\r\n"},
+		{name: "nil bulk", in: "$-1\r\n"},
+		{name: "nested array", in: "*2\r\n*2\r\n:1\r\n$2\r\n\r\n\r\n$-1\r\n"},
+		{name: "truncated bulk", in: "$5\r\nab\r\n", err: true},
+		{name: "unexpected type", in: "?\r\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := tt.in
+			if !tt.err {
+				// a second reply follows to check nothing more was consumed
+				in += "+NEXT\r\n"
+			}
+			r := newReader(strings.NewReader(in))
+			reply, err := r.readReply()
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", reply)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(reply) != tt.in {
+				t.Errorf("got %q, want %q", reply, tt.in)
+			}
+			next, err := r.readReply()
+			if err != nil || string(next) != "+NEXT\r\n" {
+				t.Errorf("next reply is %q, %v", next, err)
+			}
+		})
+	}
+}
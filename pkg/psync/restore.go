@@ -0,0 +1,73 @@
+package psync
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Restore loads the rdb file at path, or stdin for "-", into the dest
+// endpoint, flushing it first when flush is set.
+func Restore(path, dest string, flush bool, opts LoadOptions) error {
+	r, err := parseURI(dest)
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+	f, size, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	if flush {
+		err = flushDest(ctx, r)
+		if err != nil {
+			return err
+		}
+	}
+	err = loadRDB(ctx, bufio.NewReader(f), r, size, nil, opts)
+	if err != nil {
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	return nil
+}
+
+// openInput opens path, or stdin for "-", and returns its size, which is -1
+// when it isn't known upfront.
+func openInput(path string) (io.ReadCloser, int, error) {
+	if path == "-" {
+		return os.Stdin, -1, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return f, int(info.Size()), nil
+}
+
+func flushDest(ctx context.Context, r *redis) error {
+	c, err := r.redigo(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Do("FLUSHALL")
+	if err != nil {
+		return fmt.Errorf("failed to flush %s: %w", r, err)
+	}
+	// function libraries survive FLUSHALL, redis before 7 has none
+	_, err = c.Do("FUNCTION", "FLUSH")
+	if err != nil && !strings.HasPrefix(err.Error(), "ERR unknown command") {
+		return fmt.Errorf("failed to flush functions of %s: %w", r, err)
+	}
+	return nil
+}
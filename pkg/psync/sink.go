@@ -0,0 +1,355 @@
+package psync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxInflight bounds the commands sent to the destination that have not been
+// acknowledged yet, writers block once it is reached unless they are in the
+// middle of a transaction.
+const maxInflight = 10000
+
+// sink applies commands to the destination. Commands stay in flight until
+// their reply has been read, so after the destination connection breaks it
+// reconnects and replays exactly the unacknowledged ones, in order.
+type sink struct {
+	ctx   context.Context
+	dest  *redis
+	max   int
+	retry backoff
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// connected is false while the destination is being reconnected, writes
+	// are only queued until the replay
+	connected bool
+	inflight  []*pending
+	// sent counts the inflight commands written to the current connection
+	sent int
+	// replied counts the inflight commands whose reply has been read but
+	// that are part of a transaction that hasn't been committed yet
+	replied int
+	inTx    bool
+	// writingTx is set between a MULTI and its EXEC or DISCARD written by the
+	// stream, a transaction may exceed max since none of it is acknowledged
+	// before it is committed
+	writingTx bool
+	// skip counts replies to commands sent by the sink itself
+	skip    int
+	db      int
+	applied int64
+	// err stops the sink for good, e.g. when the destination refuses writes
+	err error
+}
+
+type pending struct {
+	cmd *command
+	// db is the database selected when cmd was sent
+	db int
+	// end is the replication offset right after cmd, -1 for commands that
+	// are not part of the replication stream
+	end int64
+}
+
+func newSink(ctx context.Context, dest *redis) *sink {
+	s := &sink{
+		ctx:     ctx,
+		dest:    dest,
+		max:     maxInflight,
+		retry:   backoff{min: minRetryDelay, max: maxRetryDelay},
+		applied: -1,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *sink) connect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.dest.connect(s.ctx)
+	if err != nil {
+		return err
+	}
+	s.connected = true
+	return nil
+}
+
+// run reads the replies of the destination until the sink is stopped,
+// reconnecting whenever the connection breaks.
+func (s *sink) run() {
+	go func() {
+		<-s.ctx.Done()
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+	go s.writeLoop()
+	for {
+		err := s.readReplies()
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.disconnect()
+		for {
+			delay := s.retry.next()
+			fmt.Printf("lost destination %s: %v, reconnecting in %s (attempt %d)\n", s.dest, err, delay, s.retry.attempt)
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			err = s.reconnect()
+			if err == nil {
+				break
+			}
+		}
+		s.retry.reset()
+	}
+}
+
+func (s *sink) readReplies() error {
+	for {
+		// read_timeout only applies while replies are due, a quiet source
+		// leaves the destination idle
+		if !s.awaitReplies() {
+			return s.ctx.Err()
+		}
+		reply, err := s.dest.reader.readReply()
+		if err != nil {
+			return err
+		}
+		err = s.ack(reply)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// awaitReplies waits until a reply is due, it reports false once the sink is
+// stopped.
+func (s *sink) awaitReplies() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.skip == 0 && s.replied >= s.sent && s.ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	return s.ctx.Err() == nil
+}
+
+func (s *sink) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = false
+	err := s.dest.close()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// reconnect restores the database of the first unacknowledged command and
+// replays everything still in flight.
+func (s *sink) reconnect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.dest.connect(s.ctx)
+	if err != nil {
+		return err
+	}
+	db := s.db
+	if len(s.inflight) > 0 {
+		db = s.inflight[0].db
+	}
+	s.dest.writer.buf.Write(newCommand("SELECT", strconv.Itoa(db)).raw)
+	s.skip = 1
+	for _, p := range s.inflight {
+		s.dest.writer.buf.Write(p.cmd.raw)
+	}
+	err = s.dest.writer.flush()
+	if err != nil {
+		s.dest.close()
+		return err
+	}
+	fmt.Printf("reconnected to destination %s, replayed %d commands\n", s.dest, len(s.inflight))
+	s.sent = len(s.inflight)
+	s.replied = 0
+	s.inTx = false
+	s.connected = true
+	return nil
+}
+
+// write sends a command of the replication stream ending at offset end.
+func (s *sink) write(cmd *command, end int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.inflight) >= s.max && !s.writingTx && s.err == nil && s.ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+	s.inflight = append(s.inflight, &pending{cmd: cmd, db: s.db, end: end})
+	switch cmd.name() {
+	case "MULTI":
+		s.writingTx = true
+	case "EXEC", "DISCARD":
+		s.writingTx = false
+	}
+	if cmd.is("SELECT") && len(cmd.args) == 2 {
+		db, err := strconv.Atoi(string(cmd.args[1]))
+		if err == nil {
+			s.db = db
+		}
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+// writeLoop writes the commands in flight to the destination, outside of the
+// lock so a stalled destination doesn't block reading replies.
+func (s *sink) writeLoop() {
+	for {
+		s.mu.Lock()
+		for (!s.connected || s.sent == len(s.inflight)) && s.ctx.Err() == nil {
+			s.cond.Wait()
+		}
+		if s.ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		batch := s.inflight[s.sent:]
+		s.sent = len(s.inflight)
+		s.cond.Broadcast()
+		// a reconnect replays the batch on a new writer
+		w := s.dest.writer
+		s.mu.Unlock()
+
+		for _, p := range batch {
+			w.buf.Write(p.cmd.raw)
+		}
+		// a failed write shows up as a read error and is replayed after the
+		// reconnect, the commands are already in flight
+		err := w.flush()
+		if err != nil {
+			fmt.Println("failed to write to destination:", err)
+		}
+	}
+}
+
+// send writes a command that is not part of the replication stream.
+func (s *sink) send(args ...string) error {
+	return s.write(newCommand(args...), -1)
+}
+
+// advance records that the replication stream advanced to end without
+// anything to apply.
+func (s *sink) advance(end int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.inflight) == 0 {
+		s.applied = end
+		return
+	}
+	s.inflight[len(s.inflight)-1].end = end
+}
+
+// unavailable reports whether reply is an error of a destination that can't
+// take writes right now, e.g. while it loads its dataset or fails over, rather
+// than an error of the command itself.
+func unavailable(reply []byte) bool {
+	if len(reply) == 0 || reply[0] != '-' {
+		return false
+	}
+	code := reply[1:]
+	if i := bytes.IndexAny(code, " \r\n"); i >= 0 {
+		code = code[:i]
+	}
+	switch string(code) {
+	case "LOADING", "READONLY", "MASTERDOWN", "BUSY":
+		return true
+	}
+	return false
+}
+
+// ack consumes the reply to the oldest command in flight. It returns an error
+// when the destination is unavailable, the command then stays in flight and
+// is replayed after reconnecting.
+func (s *sink) ack(reply []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.skip > 0 {
+		s.skip--
+		return nil
+	}
+	if s.replied >= len(s.inflight) {
+		fmt.Printf("unexpected reply from destination: %q\n", reply)
+		return nil
+	}
+	p := s.inflight[s.replied]
+	if unavailable(reply) {
+		return fmt.Errorf("destination can't apply %s: %s", p.cmd.name(), bytes.TrimSpace(reply[1:]))
+	}
+	s.replied++
+	if bytes.HasPrefix(reply, []byte("-NOPERM")) {
+		s.err = fmt.Errorf("user %q lacks permission to run %s on destination %s: %s", s.dest.user, p.cmd.name(), s.dest, bytes.TrimSpace(reply[1:]))
+		s.cond.Broadcast()
+		return nil
+	}
+	if reply[0] == '-' {
+		fmt.Printf("destination error for %s: %s", p.cmd, reply)
+	}
+	switch p.cmd.name() {
+	case "MULTI":
+		s.inTx = true
+	case "EXEC", "DISCARD":
+		s.inTx = false
+	}
+	if s.inTx {
+		return nil
+	}
+	for _, p := range s.inflight[:s.replied] {
+		if p.end >= 0 {
+			s.applied = p.end
+		}
+	}
+	s.inflight = s.inflight[s.replied:]
+	s.sent -= s.replied
+	s.replied = 0
+	s.cond.Broadcast()
+	return nil
+}
+
+// drain waits until every command sent has been acknowledged.
+func (s *sink) drain() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.inflight) > 0 && s.err == nil && s.ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	return s.ctx.Err()
+}
+
+// offset is the replication offset of everything applied to the destination.
+func (s *sink) offset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.applied
+}
+
+// reset starts tracking the replication stream again at offset, e.g. after a
+// full resync.
+func (s *sink) reset(offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applied = offset
+}
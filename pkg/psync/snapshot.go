@@ -0,0 +1,68 @@
+package psync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// snapshot writes an rdb payload to a file, which only appears at its path
+// once the whole payload has been written and its checksum verified.
+type snapshot struct {
+	path string
+	file *os.File
+	crc  checksumWriter
+	size int64
+}
+
+func createSnapshot(path string) (*snapshot, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rdb snapshot: %w", err)
+	}
+	return &snapshot{
+		path: path,
+		file: f,
+	}, nil
+}
+
+func (s *snapshot) Write(b []byte) (int, error) {
+	n, err := s.file.Write(b)
+	if err != nil {
+		return n, fmt.Errorf("failed to write rdb snapshot: %w", err)
+	}
+	s.crc.Write(b[:n])
+	s.size += int64(n)
+	return n, nil
+}
+
+// commit verifies the checksum of the payload and moves the file into place.
+func (s *snapshot) commit() error {
+	ok, present := s.crc.verify()
+	if !ok {
+		return fmt.Errorf("rdb snapshot checksum mismatch after %d bytes", s.size)
+	}
+	if !present {
+		fmt.Println("rdb snapshot has no checksum, the source runs with rdbchecksum no")
+	}
+	err := s.file.Sync()
+	if err == nil {
+		err = s.file.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write rdb snapshot: %w", err)
+	}
+	err = os.Rename(s.file.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("failed to move rdb snapshot to %s: %w", s.path, err)
+	}
+	fmt.Printf("saved %d bytes of rdb to %s\n", s.size, s.path)
+	return nil
+}
+
+// abort discards the snapshot unless it has been committed.
+func (s *snapshot) abort() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
@@ -0,0 +1,255 @@
+package psync
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+)
+
+var errSpoolFull = errors.New("replication spool is full")
+
+// commandReader is a source of replication stream commands.
+type commandReader interface {
+	readCommand() (*command, error)
+}
+
+// spool drains the replication stream of the source into a file while the rdb
+// is being loaded, so the source doesn't have to buffer it. Reading from the
+// spool replays the spooled commands and then hands over to the source.
+type spool struct {
+	src   *reader
+	limit int64
+	file  *os.File
+	// replay reads the spool file back through replayFile
+	replay     *reader
+	replayFile *os.File
+	// last is the first command the spooler read after the handoff, or the
+	// error that stopped it
+	last chan spooled
+	// abort is called when the spooler fails, to stop the load early
+	abort func()
+
+	mu      sync.Mutex
+	err     error
+	size    int64
+	read    int64
+	handoff bool
+	closed  bool
+	live    bool
+}
+
+type spooled struct {
+	cmd *command
+	err error
+}
+
+func newSpool(dir string, limit int64, src *reader, abort func()) (*spool, error) {
+	f, err := ioutil.TempFile(dir, "psink-spool-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool: %w", err)
+	}
+	r, err := os.Open(f.Name())
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to open spool: %w", err)
+	}
+	s := &spool{
+		src:        src,
+		limit:      limit,
+		file:       f,
+		replay:     newReader(r),
+		replayFile: r,
+		last:       make(chan spooled, 1),
+		abort:      abort,
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *spool) run() {
+	for {
+		// the source may stay silent while it waits for the load to finish,
+		// that only matters once the stream is read from the source again
+		_, err := s.src.buf.Peek(1)
+		if isTimeout(err) && !s.handingOff() {
+			continue
+		}
+		var cmd *command
+		if err == nil {
+			cmd, err = s.src.readCommand()
+		}
+		s.mu.Lock()
+		if err == nil && !s.handoff {
+			err = s.append(cmd)
+			if err == nil {
+				s.mu.Unlock()
+				continue
+			}
+		}
+		s.err = err
+		s.mu.Unlock()
+		if err != nil {
+			s.abort()
+		}
+		s.last <- spooled{cmd: cmd, err: err}
+		return
+	}
+}
+
+func (s *spool) handingOff() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handoff
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (s *spool) append(cmd *command) error {
+	if s.closed {
+		return errors.New("spool closed")
+	}
+	if s.limit > 0 && s.size+int64(cmd.len()) > s.limit {
+		return fmt.Errorf("%w: more than %d bytes arrived during the load", errSpoolFull, s.limit)
+	}
+	_, err := s.file.Write(cmd.raw)
+	if err != nil {
+		return fmt.Errorf("failed to write to spool: %w", err)
+	}
+	s.size += int64(cmd.len())
+	return nil
+}
+
+// readCommand returns the spooled commands, then reads from the source.
+func (s *spool) readCommand() (*command, error) {
+	if s.live {
+		return s.src.readCommand()
+	}
+	s.mu.Lock()
+	if s.read < s.size {
+		s.mu.Unlock()
+		cmd, err := s.replay.readCommand()
+		if err != nil {
+			return nil, fmt.Errorf("failed to replay spool: %w", err)
+		}
+		s.read += int64(cmd.len())
+		return cmd, nil
+	}
+	s.handoff = true
+	s.mu.Unlock()
+	last := <-s.last
+	if last.err == nil {
+		fmt.Printf("replayed %d spooled bytes, continuing with the source\n", s.read)
+		s.live = true
+	}
+	s.close()
+	return last.cmd, last.err
+}
+
+func (s *spool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.file.Close()
+	s.replayFile.Close()
+	os.Remove(s.file.Name())
+}
+
+// error is what stopped the spooler, if anything did.
+func (s *spool) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// downloadRDB copies the rdb payload to a file in dir as fast as the network
+// allows and returns the file, positioned at its start.
+func downloadRDB(dir string, payload io.Reader) (*os.File, error) {
+	f, err := ioutil.TempFile(dir, "psink-rdb-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rdb file: %w", err)
+	}
+	_, err = io.Copy(f, payload)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to download rdb: %w", err)
+	}
+	return f, nil
+}
+
+// payloadReader reads exactly the rdb payload announced by getRDB, either
+// size bytes or everything up to mark, and nothing of the stream after it.
+func payloadReader(r *bufio.Reader, size int, mark []byte) io.Reader {
+	if size >= 0 {
+		return io.LimitReader(r, int64(size))
+	}
+	return &markReader{r: r, mark: mark}
+}
+
+// markReader reads from r up to mark, consuming the mark but nothing that
+// follows it and without returning it.
+type markReader struct {
+	r    *bufio.Reader
+	mark []byte
+	// held are bytes that may be the start of the mark
+	held []byte
+	out  []byte
+	done bool
+}
+
+func (m *markReader) Read(b []byte) (int, error) {
+	for len(m.out) == 0 {
+		if m.done {
+			return 0, io.EOF
+		}
+		err := m.fill()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, m.out)
+	m.out = m.out[n:]
+	return n, nil
+}
+
+func (m *markReader) fill() error {
+	_, err := m.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	chunk, _ := m.r.Peek(m.r.Buffered())
+	window := append(append([]byte(nil), m.held...), chunk...)
+	if i := bytes.Index(window, m.mark); i >= 0 {
+		m.out = window[:i]
+		m.done = true
+		_, err = m.r.Discard(i + len(m.mark) - len(m.held))
+		return err
+	}
+	keep := len(window)
+	if keep > len(m.mark)-1 {
+		keep = len(m.mark) - 1
+	}
+	m.out = window[:len(window)-keep]
+	m.held = window[len(window)-keep:]
+	_, err = m.r.Discard(len(chunk))
+	return err
+}
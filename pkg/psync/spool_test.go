@@ -0,0 +1,107 @@
+package psync
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// chunkReader returns its chunks one Read at a time.
+type chunkReader struct {
+	chunks []string
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.chunks[0])
+	c.chunks[0] = c.chunks[0][n:]
+	if len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestMarkReader(t *testing.T) {
+	mark := strings.Repeat("0123456789", 4)
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+		rest   string
+		err    error
+	}{
+		{
+			name:   "mark in one read",
+			chunks: []string{"REDIS0011payload" + mark + "*1\r\n"},
+			want:   "REDIS0011payload",
+			rest:   "*1\r\n",
+		},
+		{
+			name:   "mark split across reads",
+			chunks: []string{"REDIS0011payload" + mark[:15], mark[15:] + "*1\r\n"},
+			want:   "REDIS0011payload",
+			rest:   "*1\r\n",
+		},
+		{
+			name:   "mark split after its first byte",
+			chunks: []string{"REDIS0011payload" + mark[:1], mark[1:39], mark[39:], "+PING"},
+			want:   "REDIS0011payload",
+			rest:   "+PING",
+		},
+		{
+			name:   "payload with a partial mark",
+			chunks: []string{"REDIS" + mark[:20], "payload" + mark[:39], mark},
+			want:   "REDIS" + mark[:20] + "payload" + mark[:39],
+		},
+		{
+			name:   "payload starting with the mark cut off",
+			chunks: []string{mark},
+			want:   "",
+		},
+		{
+			name:   "missing mark",
+			chunks: []string{"REDIS0011payload", mark[:39]},
+			err:    io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bufio.NewReaderSize(&chunkReader{chunks: tt.chunks}, 16)
+			got, err := ioutil.ReadAll(payloadReader(buf, -1, []byte(mark)))
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("got payload %q, want %q", got, tt.want)
+			}
+			rest, _ := ioutil.ReadAll(buf)
+			if string(rest) != tt.rest {
+				t.Errorf("left %q in the stream, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestMarkReaderOneByte(t *testing.T) {
+	mark := strings.Repeat("abcdefghij", 4)
+	payload := strings.Repeat("abcdefghij", 3) + "x" + mark[:30] + "y"
+	buf := bufio.NewReaderSize(&chunkReader{chunks: strings.Split(payload+mark+"+OK", "")}, 16)
+	got, err := ioutil.ReadAll(payloadReader(buf, -1, []byte(mark)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != payload {
+		t.Errorf("got payload %q, want %q", got, payload)
+	}
+	rest, _ := ioutil.ReadAll(buf)
+	if string(rest) != "+OK" {
+		t.Errorf("left %q in the stream", rest)
+	}
+}
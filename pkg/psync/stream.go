@@ -0,0 +1,475 @@
+package psync
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func parseRawStreamID(raw []byte) streamID {
+	return streamID{
+		ms:  binary.BigEndian.Uint64(raw[:8]),
+		seq: binary.BigEndian.Uint64(raw[8:]),
+	}
+}
+
+type streamEntry struct {
+	id     streamID
+	fields [][]byte
+}
+
+type streamPending struct {
+	id            streamID
+	deliveryTime  uint64
+	deliveryCount uint64
+	consumer      string
+}
+
+// loadStream recreates a stream with XADD, keeping the ids of its entries,
+// followed by its last id and its consumer groups with their consumers and
+// pending entries. Since redis 7 the stream also counts the entries ever
+// added and remembers the largest deleted id, which groups use to compute
+// their lag.
+func (r *rdb) loadStream(key []byte, t byte) error {
+	nodes, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	c := r.newChunker("XADD", key)
+	c.each = true
+	defer c.abort()
+	for i := uint64(0); i < nodes; i++ {
+		nodeKey, err := r.loadString()
+		if err != nil {
+			return err
+		}
+		if len(nodeKey) != 16 {
+			return fmt.Errorf("invalid stream node key of %d bytes", len(nodeKey))
+		}
+		lp, err := r.loadString()
+		if err != nil {
+			return err
+		}
+		entries, err := loadStreamListpack(lp, parseRawStreamID(nodeKey))
+		if err != nil {
+			return fmt.Errorf("failed to parse stream %s: %w", key, err)
+		}
+		for _, e := range entries {
+			err = c.add(redigo.Args{}.Add(e.id.String()).AddFlat(e.fields)...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	n, err := c.close()
+	if err != nil {
+		return err
+	}
+	added := uint64(n)
+	length, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	if length != added {
+		fmt.Printf("stream %s has %d entries, but %d were found\n", key, length, added)
+	}
+	lastID, err := r.loadStreamID()
+	if err != nil {
+		return err
+	}
+	setID := []interface{}{key, lastID.String()}
+	if t >= TypeStreamListPacks2 {
+		// the first id follows from the entries
+		_, err = r.loadStreamID()
+		if err != nil {
+			return err
+		}
+		maxDeleted, err := r.loadStreamID()
+		if err != nil {
+			return err
+		}
+		entriesAdded, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		setID = append(setID, "ENTRIESADDED", entriesAdded, "MAXDELETEDID", maxDeleted.String())
+	}
+
+	if added == 0 {
+		// a stream without entries only exists with a group, so create one
+		// for the time being
+		_, err = r.conn.Do("XGROUP", "CREATE", key, "psink", "$", "MKSTREAM")
+		if err == nil {
+			_, err = r.conn.Do("XGROUP", "DESTROY", key, "psink")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create empty stream %s: %w", key, err)
+		}
+	}
+	_, err = r.conn.Do("XSETID", setID...)
+	if err != nil {
+		return fmt.Errorf("failed to XSETID %s %s: %w", key, lastID, err)
+	}
+
+	groups, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < groups; i++ {
+		err = r.loadStreamGroup(key, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadStreamGroup creates a consumer group with its consumers and claims its
+// pending entries for them with the original delivery time and count.
+func (r *rdb) loadStreamGroup(key []byte, t byte) error {
+	name, err := r.loadString()
+	if err != nil {
+		return err
+	}
+	lastID, err := r.loadStreamID()
+	if err != nil {
+		return err
+	}
+	create := []interface{}{"CREATE", key, name, lastID.String()}
+	if t >= TypeStreamListPacks2 {
+		entriesRead, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		// -1 marks an unknown count
+		if entriesRead != math.MaxUint64 {
+			create = append(create, "ENTRIESREAD", entriesRead)
+		}
+	}
+	size, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	pel := make([]*streamPending, 0, size)
+	byID := make(map[streamID]*streamPending, size)
+	for i := uint64(0); i < size; i++ {
+		raw, err := r.loadRaw(16)
+		if err != nil {
+			return err
+		}
+		deliveryTime, err := r.loadUint64()
+		if err != nil {
+			return err
+		}
+		deliveryCount, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		p := &streamPending{
+			id:            parseRawStreamID(raw),
+			deliveryTime:  deliveryTime,
+			deliveryCount: deliveryCount,
+		}
+		pel = append(pel, p)
+		byID[p.id] = p
+	}
+
+	consumers, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	names := make([][]byte, 0, consumers)
+	for i := uint64(0); i < consumers; i++ {
+		consumer, err := r.loadString()
+		if err != nil {
+			return err
+		}
+		// the seen and active times can't be restored
+		_, err = r.loadUint64()
+		if err != nil {
+			return err
+		}
+		if t == TypeStreamListPacks3 {
+			_, err = r.loadUint64()
+			if err != nil {
+				return err
+			}
+		}
+		n, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < n; j++ {
+			raw, err := r.loadRaw(16)
+			if err != nil {
+				return err
+			}
+			if p, ok := byID[parseRawStreamID(raw)]; ok {
+				p.consumer = string(consumer)
+			}
+		}
+		names = append(names, consumer)
+	}
+
+	_, err = r.conn.Do("XGROUP", create...)
+	if err != nil {
+		return fmt.Errorf("failed to create group %s of stream %s: %w", name, key, err)
+	}
+	for _, consumer := range names {
+		_, err = r.conn.Do("XGROUP", "CREATECONSUMER", key, name, consumer)
+		if err != nil {
+			return fmt.Errorf("failed to create consumer %s in group %s of stream %s: %w", consumer, name, key, err)
+		}
+	}
+	var lost int
+	for _, p := range pel {
+		if p.consumer == "" {
+			lost++
+			continue
+		}
+		ids, err := redigo.Values(r.conn.Do("XCLAIM", key, name, p.consumer, 0, p.id.String(),
+			"TIME", p.deliveryTime, "RETRYCOUNT", p.deliveryCount, "FORCE", "JUSTID"))
+		if err != nil {
+			return fmt.Errorf("failed to XCLAIM %s in group %s of stream %s: %w", p.id, name, key, err)
+		}
+		// entries deleted from the stream can't be claimed
+		if len(ids) == 0 {
+			lost++
+		}
+	}
+	if lost > 0 {
+		fmt.Printf("group %s of stream %s lost %d of %d pending entries\n", name, key, lost, len(pel))
+	}
+	return nil
+}
+
+// skipStream reads a stream of type t like loadStream, without writing it.
+func (r *rdb) skipStream(t byte) error {
+	nodes, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		_, err = r.loadString()
+		if err == nil {
+			_, err = r.loadString()
+		}
+		if err == nil {
+			err = r.full()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// the length and last id, then the first and max deleted ids and the
+	// entries added
+	_, _, err = r.loadLen()
+	if err == nil {
+		_, err = r.loadStreamID()
+	}
+	if err == nil && t >= TypeStreamListPacks2 {
+		_, err = r.loadStreamID()
+		if err == nil {
+			_, err = r.loadStreamID()
+		}
+		if err == nil {
+			_, _, err = r.loadLen()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	groups, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < groups; i++ {
+		err = r.skipStreamGroup(t)
+		if err == nil {
+			err = r.full()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipStreamGroup reads a consumer group like loadStreamGroup.
+func (r *rdb) skipStreamGroup(t byte) error {
+	_, err := r.loadString()
+	if err == nil {
+		_, err = r.loadStreamID()
+	}
+	if err == nil && t >= TypeStreamListPacks2 {
+		_, _, err = r.loadLen()
+	}
+	if err != nil {
+		return err
+	}
+	size, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < size; i++ {
+		_, err = r.loadRaw(16)
+		if err == nil {
+			_, err = r.loadUint64()
+		}
+		if err == nil {
+			_, _, err = r.loadLen()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	consumers, _, err := r.loadLen()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < consumers; i++ {
+		_, err = r.loadString()
+		if err == nil {
+			_, err = r.loadUint64()
+		}
+		if err == nil && t == TypeStreamListPacks3 {
+			_, err = r.loadUint64()
+		}
+		if err != nil {
+			return err
+		}
+		n, _, err := r.loadLen()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < n; j++ {
+			_, err = r.loadRaw(16)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *rdb) loadStreamID() (streamID, error) {
+	ms, _, err := r.loadLen()
+	if err != nil {
+		return streamID{}, err
+	}
+	seq, _, err := r.loadLen()
+	if err != nil {
+		return streamID{}, err
+	}
+	return streamID{ms: ms, seq: seq}, nil
+}
+
+// loadStreamListpack returns the entries of a stream listpack that haven't
+// been deleted. Entry ids are stored relative to the master id of the node
+// and their fields are omitted when they match the master entry.
+func loadStreamListpack(lp []byte, master streamID) ([]streamEntry, error) {
+	buf := newInput(lp)
+	_, err := loadListpackLength(buf)
+	if err != nil {
+		return nil, err
+	}
+	next := func() (int64, error) {
+		b, err := loadListpackEntry(buf)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(string(b), 10, 64)
+	}
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := next()
+	if err != nil {
+		return nil, err
+	}
+	numFields, err := next()
+	if err != nil {
+		return nil, err
+	}
+	masterFields := make([][]byte, numFields)
+	for i := range masterFields {
+		masterFields[i], err = loadListpackEntry(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the master entry is terminated by a zero
+	_, err = loadListpackEntry(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]streamEntry, 0, count)
+	for i := int64(0); i < count+deleted; i++ {
+		flags, err := next()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		var fields [][]byte
+		if flags&StreamItemFlagSameFields != 0 {
+			for _, field := range masterFields {
+				value, err := loadListpackEntry(buf)
+				if err != nil {
+					return nil, err
+				}
+				fields = append(fields, field, value)
+			}
+		} else {
+			n, err := next()
+			if err != nil {
+				return nil, err
+			}
+			for j := int64(0); j < 2*n; j++ {
+				b, err := loadListpackEntry(buf)
+				if err != nil {
+					return nil, err
+				}
+				fields = append(fields, b)
+			}
+		}
+		// the lp-count of the entry, for iterating backwards
+		_, err = loadListpackEntry(buf)
+		if err != nil {
+			return nil, err
+		}
+		if flags&StreamItemFlagDeleted != 0 {
+			continue
+		}
+		entries = append(entries, streamEntry{
+			id: streamID{
+				ms:  master.ms + uint64(msDiff),
+				seq: master.seq + uint64(seqDiff),
+			},
+			fields: fields,
+		})
+	}
+	if b, err := buf.ReadByte(); err != nil || b != 0xff {
+		return nil, fmt.Errorf("stream listpack is not terminated")
+	}
+	return entries, nil
+}
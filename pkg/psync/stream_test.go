@@ -0,0 +1,137 @@
+package psync
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func lpInt(v int64) []byte {
+	if v >= 0 && v < 128 {
+		return lpEntry(byte(v))
+	}
+	enc := make([]byte, 9)
+	enc[0] = 0xf4
+	binary.LittleEndian.PutUint64(enc[1:], uint64(v))
+	return lpEntry(enc...)
+}
+
+// streamNode builds the listpack of a stream node: the master entry with
+// count, deleted and the master fields, then the entries.
+func streamNode(count, deleted int64, fields []string, entries ...[][]byte) []byte {
+	lp := [][]byte{lpInt(count), lpInt(deleted), lpInt(int64(len(fields)))}
+	for _, f := range fields {
+		lp = append(lp, lpString(f))
+	}
+	lp = append(lp, lpInt(0))
+	for _, e := range entries {
+		lp = append(lp, e...)
+	}
+	return listpack(lp...)
+}
+
+// streamItem is an entry of a node, flags and id diffs followed by its
+// fields or values and its lp-count.
+func streamItem(flags, ms, seq int64, items ...[]byte) [][]byte {
+	e := [][]byte{lpInt(flags), lpInt(ms), lpInt(seq)}
+	e = append(e, items...)
+	return append(e, lpInt(int64(len(items)+3)))
+}
+
+func TestLoadStreamListpack(t *testing.T) {
+	master := streamID{ms: 1700000000000, seq: 5}
+	tests := []struct {
+		name string
+		lp   []byte
+		want []streamEntry
+	}{
+		{
+			name: "same fields",
+			lp: streamNode(2, 0, []string{"a", "b"},
+				streamItem(StreamItemFlagSameFields, 0, 0, lpString("1"), lpString("2")),
+				streamItem(StreamItemFlagSameFields, 1, 0, lpInt(3), lpString("4"))),
+			want: []streamEntry{
+				{id: master, fields: bs("a", "1", "b", "2")},
+				{id: streamID{ms: master.ms + 1, seq: 5}, fields: bs("a", "3", "b", "4")},
+			},
+		},
+		{
+			name: "own fields",
+			lp: streamNode(1, 0, []string{"a"},
+				streamItem(StreamItemFlagNone, 0, 1, lpInt(2), lpString("x"), lpString("1"), lpString("y"), lpString("2"))),
+			want: []streamEntry{
+				{id: streamID{ms: master.ms, seq: 6}, fields: bs("x", "1", "y", "2")},
+			},
+		},
+		{
+			name: "deleted entries",
+			lp: streamNode(1, 2, []string{"a"},
+				streamItem(StreamItemFlagSameFields|StreamItemFlagDeleted, 0, 0, lpString("gone")),
+				streamItem(StreamItemFlagNone, 0, 1, lpInt(1), lpString("a"), lpString("kept")),
+				streamItem(StreamItemFlagDeleted, 0, 2, lpInt(1), lpString("z"), lpString("gone"))),
+			want: []streamEntry{
+				{id: streamID{ms: master.ms, seq: 6}, fields: bs("a", "kept")},
+			},
+		},
+		{
+			name: "large id diff",
+			lp: streamNode(1, 0, []string{"a"},
+				streamItem(StreamItemFlagSameFields, 86400000000, 1000, lpString("v"))),
+			want: []streamEntry{
+				{id: streamID{ms: master.ms + 86400000000, seq: 1005}, fields: bs("a", "v")},
+			},
+		},
+		{
+			name: "only deleted entries",
+			lp: streamNode(0, 1, []string{"a"},
+				streamItem(StreamItemFlagSameFields|StreamItemFlagDeleted, 0, 0, lpString("gone"))),
+			want: []streamEntry{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadStreamListpack(tt.lp, master)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadStreamListpackCorrupt(t *testing.T) {
+	lp := streamNode(1, 0, []string{"a"}, streamItem(StreamItemFlagSameFields, 0, 0, lpString("v")))
+	// an entry more than counted runs into the terminator
+	more := streamNode(2, 0, []string{"a"}, streamItem(StreamItemFlagSameFields, 0, 0, lpString("v")))
+	// an entry less than counted leaves one before the terminator
+	less := streamNode(0, 0, []string{"a"}, streamItem(StreamItemFlagSameFields, 0, 0, lpString("v")))
+	for name, lp := range map[string][]byte{
+		"truncated":      lp[:len(lp)-3],
+		"no terminator":  lp[:len(lp)-1],
+		"count too high": more,
+		"count too low":  less,
+	} {
+		_, err := loadStreamListpack(lp, streamID{})
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseRawStreamID(t *testing.T) {
+	raw := []byte{0, 0, 1, 0x8b, 0xcf, 0xe5, 0x68, 0x00, 0, 0, 0, 0, 0, 0, 0, 7}
+	got := parseRawStreamID(raw)
+	if got.String() != "1700000000000-7" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func bs(s ...string) [][]byte {
+	b := make([][]byte, len(s))
+	for i := range s {
+		b[i] = []byte(s[i])
+	}
+	return b
+}
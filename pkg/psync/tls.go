@@ -0,0 +1,72 @@
+package psync
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// TLSOptions describe how to establish TLS to a redis.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of the CAs to trust instead of the system ones.
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and key to present.
+	CertFile, KeyFile string
+	// ServerName overrides the name used for SNI and verification, which
+	// defaults to the host being connected to.
+	ServerName string
+	// InsecureSkipVerify disables certificate verification, for testing only.
+	InsecureSkipVerify bool
+}
+
+// Config builds the tls.Config described by the options.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// handshake wraps conn in TLS and completes the handshake before ctx expires.
+func handshake(ctx context.Context, conn net.Conn, addr string, config *tls.Config) (net.Conn, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	c := tls.Client(conn, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	err := c.Handshake()
+	if err != nil {
+		return nil, fmt.Errorf("tls handshake with %s failed: %w", addr, err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
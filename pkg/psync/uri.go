@@ -0,0 +1,167 @@
+package psync
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uriOptions are the query options understood in an endpoint URI.
+var uriOptions = map[string]func(r *redis, t *TLSOptions, v string) error{
+	"db": func(r *redis, _ *TLSOptions, v string) error {
+		return parseDB(v)
+	},
+	"dial_timeout": func(r *redis, _ *TLSOptions, v string) error {
+		return parseDuration(&r.timeouts.Dial, v)
+	},
+	"read_timeout": func(r *redis, _ *TLSOptions, v string) error {
+		return parseDuration(&r.timeouts.Read, v)
+	},
+	"write_timeout": func(r *redis, _ *TLSOptions, v string) error {
+		return parseDuration(&r.timeouts.Write, v)
+	},
+	"keepalive": func(r *redis, _ *TLSOptions, v string) error {
+		return parseDuration(&r.timeouts.KeepAlive, v)
+	},
+	"tls_ca": func(_ *redis, t *TLSOptions, v string) error {
+		t.CAFile = v
+		return nil
+	},
+	"tls_cert": func(_ *redis, t *TLSOptions, v string) error {
+		t.CertFile = v
+		return nil
+	},
+	"tls_key": func(_ *redis, t *TLSOptions, v string) error {
+		t.KeyFile = v
+		return nil
+	},
+	"tls_server_name": func(_ *redis, t *TLSOptions, v string) error {
+		t.ServerName = v
+		return nil
+	},
+	"tls_insecure": func(_ *redis, t *TLSOptions, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", v)
+		}
+		t.InsecureSkipVerify = b
+		return nil
+	},
+}
+
+// parseURI parses an endpoint of the form
+//
+//	redis://[[user]:password@]host[:port][/db][?option=value...]
+//	rediss://[[user]:password@]host[:port][/db][?option=value...]
+//	unix://[[user]:password@]/path/to/redis.sock[?db=n&option=value...]
+//
+// A bare host:port is treated as redis://host:port. The db can only be 0,
+// psink covers all databases and follows the SELECTs of the source.
+func parseURI(s string) (*redis, error) {
+	if !strings.Contains(s, "://") {
+		s = "redis://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis uri: %w", err)
+	}
+	r := &redis{}
+	switch u.Scheme {
+	case "redis", "rediss":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid redis uri %s: missing host", redact(u))
+		}
+		r.network = "tcp"
+		r.addr = u.Host
+		if u.Port() == "" {
+			r.addr = net.JoinHostPort(u.Hostname(), "6379")
+		}
+		db := strings.Trim(u.Path, "/")
+		if db != "" {
+			err = parseDB(db)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redis uri %s: %w", redact(u), err)
+			}
+		}
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid redis uri %s: missing socket path", redact(u))
+		}
+		r.network = "unix"
+		r.addr = u.Path
+	default:
+		return nil, fmt.Errorf("invalid redis uri %s: unsupported scheme %q, expected redis, rediss or unix", redact(u), u.Scheme)
+	}
+	if u.User != nil {
+		r.user = u.User.Username()
+		r.password, _ = u.User.Password()
+		if r.password == "" {
+			return nil, fmt.Errorf("invalid redis uri %s: user %q given without a password", redact(u), r.user)
+		}
+	}
+
+	var t TLSOptions
+	for k, vs := range u.Query() {
+		opt, ok := uriOptions[k]
+		if !ok {
+			return nil, fmt.Errorf("invalid redis uri %s: unknown option %q, expected one of %s", redact(u), k, strings.Join(optionNames(), ", "))
+		}
+		if strings.HasPrefix(k, "tls_") && u.Scheme != "rediss" {
+			return nil, fmt.Errorf("invalid redis uri %s: option %q requires the rediss scheme", redact(u), k)
+		}
+		err = opt(r, &t, vs[len(vs)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis uri %s: option %q: %w", redact(u), k, err)
+		}
+	}
+	if u.Scheme == "rediss" {
+		r.tls, err = t.Config()
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis uri %s: %w", redact(u), err)
+		}
+	}
+	return r, nil
+}
+
+// redact hides the password of u for error messages.
+func redact(u *url.URL) string {
+	if _, ok := u.User.Password(); !ok {
+		return u.String()
+	}
+	c := *u
+	c.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return c.String()
+}
+
+func parseDB(v string) error {
+	db, err := strconv.Atoi(v)
+	if err != nil || db < 0 {
+		return fmt.Errorf("database must be a non-negative number, got %q", v)
+	}
+	if db != 0 {
+		return fmt.Errorf("database %d can't be selected, psink covers all databases and keeps the ones of the source", db)
+	}
+	return nil
+}
+
+func parseDuration(d *time.Duration, v string) error {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("expected a duration such as 5s, got %q", v)
+	}
+	*d = parsed
+	return nil
+}
+
+func optionNames() []string {
+	names := make([]string, 0, len(uriOptions))
+	for k := range uriOptions {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}